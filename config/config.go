@@ -5,18 +5,27 @@ import (
 	"os"
 )
 
+// Config of a master. Masters sharing a database must also share [Config.FileStoragePath] (e.g. a network file
+// system), a result submitted to one master may be processed by another.
 type Config struct {
 	ReleaseMode         bool              `json:"releaseMode"`
 	Addr                string            `json:"addr"`
 	Database            Database          `json:"database"`
 	VerificationEmail   VerificationEmail `json:"verificationEmail"`
 	FileStoragePath     string            `json:"fileStoragePath"`
-	WorkerKey           string            `json:"workerKey"`
+	WorkerKey           string            `json:"workerKey"` // shared by workers without own credentials, disabled if empty
+	AdminKey            string            `json:"adminKey"`  // admin api is disabled if it is empty
 	TokenSecretKey      string            `json:"tokenSecretKey"`
 	BackendURL          string            `json:"backendUrl"`
 	FrontendURL         string            `json:"frontendUrl"`
 	CROSAllowOrigins    []string          `json:"crosAllowOrigins"`
 	ForwardedByClientIP bool              `json:"forwardedByClientIP"`
+	NodeID              int64             `json:"nodeId"` // unique among masters sharing a database, 1 by default
+	Scheduler           Scheduler         `json:"scheduler"`
+	Comparison          Comparison        `json:"comparison"`
+
+	// the shared worker key is rejected as long as a worker credential is active
+	DisableWorkerKeyWithCredentials bool `json:"disableWorkerKeyWithCredentials"`
 }
 
 type Database struct {
@@ -24,6 +33,20 @@ type Database struct {
 	Type           string `json:"type"`
 }
 
+// Politeness limits for checking the same host, 0 disables a limit
+type Scheduler struct {
+	HostConcurrency int `json:"hostConcurrency"` // checks of one host running at the same time
+	HostSpacing     int `json:"hostSpacing"`     // seconds between the start of two checks of one host
+	MaxJitter       int `json:"maxJitter"`       // seconds, spreads the checks of sentries with the same schedule
+}
+
+// Comparison of the images submitted by workers
+type Comparison struct {
+	Workers    int `json:"workers"`    // images compared at the same time, the number of CPUs if it is 0
+	QueueSize  int `json:"queueSize"`  // images waiting for a worker, more are compared in the next cleanup round
+	RowWorkers int `json:"rowWorkers"` // goroutines comparing the rows of one image, 0 or 1 to disable it
+}
+
 type VerificationEmail struct {
 	Server   string `json:"server"`
 	Port     int    `json:"port"`
@@ -34,6 +57,19 @@ type VerificationEmail struct {
 var config Config
 
 func Load(file string) error {
+	config = Config{
+		NodeID: 1,
+		Scheduler: Scheduler{
+			HostConcurrency: 2,
+			HostSpacing:     10,
+			MaxJitter:       300,
+		},
+		Comparison: Comparison{
+			QueueSize:  1000,
+			RowWorkers: 1,
+		},
+	}
+
 	configFile, err := os.Open(file)
 	if err != nil {
 		return err
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/websentry/websentry/models"
+)
+
+// a worker that is running a task doesn't fetch new ones, so it has to be longer than a task may take
+const workerStaleTimeout = 5 * time.Minute
+
+type WorkerJSON struct {
+	ID           string    `json:"id"`
+	Version      string    `json:"version"`
+	Capabilities []string  `json:"capabilities"`
+	Tags         []string  `json:"tags"`
+	Protocol     int       `json:"protocol"`
+	Features     []string  `json:"features"`
+	IP           string    `json:"ip"`
+	Live         bool      `json:"live"`
+	StartedAt    time.Time `json:"startedAt"`
+	LastSeenAt   time.Time `json:"lastSeenAt"`
+	Assigned     int       `json:"assigned"`
+	Completed    int       `json:"completed"`
+	Failed       int       `json:"failed"`
+	Throughput   float64   `json:"throughput"` // completed tasks per hour since it was first seen
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func AdminWorkerList(c *gin.Context) {
+	var results []models.Worker
+	err := models.Transaction(func(tx models.TX) (err error) {
+		results, err = tx.GetWorkers()
+		return
+	})
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return
+	}
+
+	now := time.Now()
+	workers := make([]WorkerJSON, len(results))
+	for i, w := range results {
+		var capabilities, tags []string
+		if w.Capabilities != "" {
+			err = errors.WithStack(json.Unmarshal([]byte(w.Capabilities), &capabilities))
+			if err != nil {
+				InternalErrorResponse(c, err)
+				return
+			}
+		}
+		if w.Tags != "" {
+			err = errors.WithStack(json.Unmarshal([]byte(w.Tags), &tags))
+			if err != nil {
+				InternalErrorResponse(c, err)
+				return
+			}
+		}
+
+		// at least one hour, otherwise it is meaningless for new workers
+		throughput := float64(w.Completed) / math.Max(now.Sub(w.CreatedAt).Hours(), 1)
+
+		workers[i] = WorkerJSON{
+			w.ID, w.Version, capabilities, tags, w.Protocol, models.FeatureNames(w.FeatureSet()), w.IP,
+			now.Sub(w.LastSeenAt) < workerStaleTimeout,
+			w.StartedAt, w.LastSeenAt,
+			w.Assigned, w.Completed, w.Failed, throughput,
+			w.CreatedAt,
+		}
+	}
+
+	JSONResponse(c, CodeOK, "", gin.H{
+		"workers": workers,
+	})
+}
@@ -1,12 +1,13 @@
 package controllers
 
 func Init() {
-	go sentryTaskScheduler()
-
 	// worker
-	taskq.pQueue = make(chan int32, queueBuffer)
-	taskq.nQueue = make(chan int32, queueBuffer)
-	taskq.info = make(map[int32]*taskInfo)
+	taskq.notify = make(chan bool, queueBuffer)
+	taskq.wait = make(map[int64]chan bool)
+	startComparisonWorkers()
 
+	// it also picks up the tasks left by the last run
 	go cleanTask()
+
+	go sentryTaskScheduler()
 }
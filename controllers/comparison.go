@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/websentry/websentry/config"
+	"github.com/websentry/websentry/models"
+)
+
+// The results of sentry tasks are compared by a fixed number of goroutines, so that a burst of submissions can't
+// take all the CPU of the master. Results that don't fit in the queue stay in the database and are picked up by
+// [processUnprocessedSentryTasks].
+var comparisonQueue chan *models.Task
+
+func startComparisonWorkers() {
+	c := config.GetConfig().Comparison
+	workers := c.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	comparisonQueue = make(chan *models.Task, c.QueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for t := range comparisonQueue {
+				processSentryTask(t)
+			}
+		}()
+	}
+}
+
+// queueSentryTask hands the result over to the comparison workers, it doesn't block if the queue is full
+func queueSentryTask(t *models.Task) {
+	select {
+	case comparisonQueue <- t:
+	default:
+		log.Printf("[queueSentryTask] Info: comparison queue is full, task: %d is processed later \n", t.ID)
+	}
+}
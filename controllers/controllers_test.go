@@ -0,0 +1,959 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"golang.org/x/text/language"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/websentry/websentry/config"
+	"github.com/websentry/websentry/fakeworker"
+	"github.com/websentry/websentry/models"
+	"github.com/websentry/websentry/utils"
+)
+
+var testDB *gorm.DB
+
+// The master runs with an in-memory SQLite database and files in a temporary directory. Workers are replaced by
+// [fakeworker.Worker], so the tests don't need a browser or network.
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// templates are loaded relative to the root of the repository
+	err := os.Chdir("..")
+	if err != nil {
+		panic(err)
+	}
+
+	dir, err := ioutil.TempDir("", "websentry-test")
+	if err != nil {
+		panic(err)
+	}
+	configFile := path.Join(dir, "config.json")
+	err = ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`{
+		"fileStoragePath": %q,
+		"workerKey": "test-key",
+		"tokenSecretKey": "test",
+		"scheduler": {"hostConcurrency": 0, "hostSpacing": 0, "maxJitter": 0}
+	}`, dir)), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = config.Load(configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	testDB, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		panic(err)
+	}
+	// an in-memory database only lives in a single connection
+	sqlDB, err := testDB.DB()
+	if err != nil {
+		panic(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	err = models.Init(testDB, 1)
+	if err != nil {
+		panic(err)
+	}
+	err = utils.Init()
+	if err != nil {
+		panic(err)
+	}
+	Init()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestWorker(script fakeworker.Script) (*fakeworker.Worker, func()) {
+	r := gin.New()
+	r.POST("/v1/worker/init", WorkerInit)
+	r.POST("/v1/worker/fetch_task", WorkerFetchTask)
+	r.POST("/v1/worker/submit_task", WorkerSubmitTask)
+	r.GET("/v1/worker/socket", WorkerSocket)
+	s := httptest.NewServer(r)
+
+	w := &fakeworker.Worker{
+		Master: s.URL,
+		ID:     "fake-test",
+		Key:    "test-key",
+		Script: script,
+	}
+	return w, s.Close
+}
+
+// newTestUser creates a user with its email notification, [cleanup] deletes them with their sentries
+func newTestUser(t *testing.T, email string) (user models.User, notification models.NotificationMethod,
+	cleanup func()) {
+	err := models.Transaction(func(tx models.TX) error {
+		return tx.CreateUser(email, "password", time.UTC, language.English)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Where("email = ?", email).First(&user).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Where("user_id = ?", user.ID).First(&notification).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup = func() {
+		testDB.Where("sentry_id IN (?)", testDB.Model(&models.Sentry{}).Select("id").Where("user_id = ?", user.ID)).
+			Delete(&models.SentryImage{})
+		for _, v := range []interface{}{&models.Sentry{}, &models.NotificationMethod{}} {
+			testDB.Where("user_id = ?", user.ID).Delete(v)
+		}
+		testDB.Delete(&user)
+	}
+	return
+}
+
+// captureEmails replaces [sendEmail], the emails are returned by [emails] as "to: subject" and their bodies
+func captureEmails() (emails func() ([]string, []string), restore func()) {
+	var mux sync.Mutex
+	var subjects, bodies []string
+	f := sendEmail
+	sendEmail = func(to string, subject string, body *string) {
+		mux.Lock()
+		defer mux.Unlock()
+		subjects = append(subjects, to+": "+subject)
+		bodies = append(bodies, *body)
+	}
+	emails = func() ([]string, []string) {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string{}, subjects...), append([]string{}, bodies...)
+	}
+	return emails, func() { sendEmail = f }
+}
+
+// runTestChecks makes all the sentries due and lets the worker run [tasks] tasks in each round
+func runTestChecks(t *testing.T, w *fakeworker.Worker, rounds int, tasks int) {
+	for i := 0; i < rounds; i++ {
+		err := testDB.Model(&models.Sentry{}).Where("1 = 1").Update("next_check_time", time.Now()).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheduleSentryTasks()
+		for j := 0; j < tasks; j++ {
+			ok, err := w.RunOnce()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("round %d: no task for the worker", i)
+			}
+		}
+		waitTasksProcessed(t)
+	}
+}
+
+func newTestSentry(t *testing.T, userID int64, notificationID int64, name string, url string) int64 {
+	return newTestSentryTask(t, userID, notificationID, name, newTestClipTask(url), `{"similarityThreshold":0.9999}`)
+}
+
+// newTestClipTask is the task of [newTestSentry]
+func newTestClipTask(url string) *models.TaskSpec {
+	return &models.TaskSpec{
+		Schema:   models.TaskSchema,
+		URL:      url,
+		Timeout:  40000,
+		Clip:     &models.Rect{X: 0, Y: 0, Width: 40, Height: 30},
+		Viewport: models.Viewport{Width: 900},
+		Output:   models.TaskOutput{Type: "png"},
+	}
+}
+
+func newTestSentryTask(t *testing.T, userID int64, notificationID int64, name string, task *models.TaskSpec,
+	trigger string) int64 {
+	taskJSON, err := task.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &models.Sentry{
+		Name:           name,
+		UserID:         userID,
+		NotificationID: notificationID,
+		RunningState:   models.RSRunning,
+		Task:           taskJSON,
+		Trigger:        trigger,
+		Interval:       60,
+		NextCheckTime:  time.Now(),
+	}
+	var id int64
+	err = models.Transaction(func(tx models.TX) (err error) {
+		id, err = tx.CreateSentry(s)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// waitTasksProcessed waits until the results are processed, processed tasks are deleted
+func waitTasksProcessed(t *testing.T) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var count int64
+		err := testDB.Model(&models.Task{}).Count(&count).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tasks are not processed", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSentryCheck runs scheduled checks from the scheduler through the worker to the comparison and notification.
+func TestSentryCheck(t *testing.T) {
+	var mux sync.Mutex
+	var emails, bodies []string
+	defer func(f func(string, string, *string)) { sendEmail = f }(sendEmail)
+	sendEmail = func(to string, subject string, body *string) {
+		mux.Lock()
+		defer mux.Unlock()
+		emails = append(emails, to+": "+subject)
+		bodies = append(bodies, *body)
+	}
+
+	var user models.User
+	var notification models.NotificationMethod
+	err := models.Transaction(func(tx models.TX) error {
+		return tx.CreateUser("check@example.com", "password", time.UTC, language.English)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Where("email = ?", "check@example.com").First(&user).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Where("user_id = ?", user.ID).First(&notification).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged := newTestSentry(t, user.ID, notification.ID, "unchanged", "https://unchanged.example.com/")
+	changed := newTestSentry(t, user.ID, notification.ID, "changed", "https://changed.example.com/")
+	failed := newTestSentry(t, user.ID, notification.ID, "failed", "https://failed.example.com/")
+	defer func() {
+		for _, v := range []interface{}{&models.Sentry{}, &models.NotificationMethod{}} {
+			testDB.Where("user_id = ?", user.ID).Delete(v)
+		}
+		testDB.Where("sentry_id IN ?", []int64{unchanged, changed, failed}).Delete(&models.SentryImage{})
+		testDB.Delete(&user)
+	}()
+
+	w, closeServer := newTestWorker(fakeworker.Script{
+		"https://changed.example.com/": {Behavior: fakeworker.ChangedAfter, After: 2},
+		"https://failed.example.com/":  {Behavior: fakeworker.Fail, FeedbackCode: 2, FeedbackMsg: "timeout"},
+	})
+	defer closeServer()
+	err = w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const rounds = 3
+	for i := 0; i < rounds; i++ {
+		// all of them are due
+		err = testDB.Model(&models.Sentry{}).Where("1 = 1").Update("next_check_time", time.Now()).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheduleSentryTasks()
+		for j := 0; j < 3; j++ {
+			ok, err := w.RunOnce()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("round %d: no task for the worker", i)
+			}
+		}
+		waitTasksProcessed(t)
+	}
+
+	sentries := map[int64]*models.Sentry{}
+	for _, id := range []int64{unchanged, changed, failed} {
+		err = models.Transaction(func(tx models.TX) (err error) {
+			sentries[id], err = tx.GetSentry(id)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s := sentries[unchanged]; s.CheckCount != rounds || s.NotifyCount != 0 {
+		t.Errorf("unexpected unchanged sentry: %+v", s)
+	}
+	if s := sentries[changed]; s.CheckCount != rounds || s.NotifyCount != 1 {
+		t.Errorf("unexpected changed sentry: %+v", s)
+	}
+	if s := sentries[failed]; s.CheckCount != 0 || s.ConsecutiveFailures != rounds ||
+		!strings.Contains(s.LastError, "timeout") {
+		t.Errorf("unexpected failed sentry: %+v", s)
+	}
+
+	var images []models.SentryImage
+	err = testDB.Where("sentry_id = ?", changed).Order("id").Find(&images).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].DiffFile != "" || images[1].DiffFile == "" {
+		t.Fatalf("unexpected images of the changed sentry: %+v", images)
+	}
+	if _, err := os.Stat(utils.ImageGetFullPath(images[1].DiffFile, true)); err != nil {
+		t.Error(err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(emails) != 1 || emails[0] != "check@example.com: changed: change detected" {
+		t.Errorf("unexpected notifications: %v", emails)
+	} else if !strings.Contains(bodies[0], "get_history_image?filename="+images[1].DiffFile) {
+		t.Errorf("the diff image is not in the email: %v", bodies[0])
+	}
+}
+
+// TestWorkerProtocolV1 checks that workers from before the protocol was negotiated still get numeric task IDs
+func TestWorkerProtocolV1(t *testing.T) {
+	user, notification, cleanup := newTestUser(t, "v1@example.com")
+	defer cleanup()
+	id := newTestSentry(t, user.ID, notification.ID, "v1", "https://v1.example.com/")
+
+	w, closeServer := newTestWorker(nil)
+	defer closeServer()
+	w.ID = "fake-v1"
+	w.Protocol = models.ProtocolV1
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestChecks(t, w, 2, 1)
+
+	var s *models.Sentry
+	err = models.Transaction(func(tx models.TX) (err error) {
+		s, err = tx.GetSentry(id)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CheckCount != 2 {
+		t.Errorf("unexpected sentry: %+v", s)
+	}
+
+	task := &models.Task{ID: 1234}
+	for _, c := range []struct {
+		protocol int
+		task     *models.Task
+		expected string
+	}{
+		{models.ProtocolV1, task, "1234"},
+		{models.ProtocolV1, nil, "-1"},
+		{models.ProtocolV2, task, `"4d2"`},
+		{models.ProtocolV2, nil, "null"},
+	} {
+		data, err := json.Marshal(workerTaskID(c.protocol, c.task))
+		if err != nil || string(data) != c.expected {
+			t.Errorf("unexpected task ID for protocol %d: %s %v", c.protocol, data, err)
+		}
+	}
+}
+
+// TestWorkerProtocolV1TaskID reads the task ID as a float64 like the JavaScript workers of [models.ProtocolV1]
+func TestWorkerProtocolV1TaskID(t *testing.T) {
+	user, notification, cleanup := newTestUser(t, "v1-id@example.com")
+	defer cleanup()
+	newTestSentry(t, user.ID, notification.ID, "v1-id", "https://v1-id.example.com/")
+
+	w, closeServer := newTestWorker(nil)
+	defer closeServer()
+	w.ID = "fake-v1-id"
+	w.Protocol = models.ProtocolV1
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// created by an older version, the worker can't read its ID
+	legacy := &models.Task{ID: 1 << 60, Mode: models.TMFullScreenshot, State: models.TSQueued, Priority: 100,
+		Task: "{}", ExpireAt: time.Now().Add(time.Hour), AvailableAt: time.Now()}
+	err = testDB.Create(legacy).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Model(&models.Sentry{}).Where("1 = 1").Update("next_check_time", time.Now()).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleSentryTasks()
+
+	post := func(endpoint string, query url.Values) json.RawMessage {
+		req, err := http.NewRequest(http.MethodPost, w.Master+"/v1/worker/"+endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("WS-Worker-ID", w.ID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r struct {
+			Code int             `json:"code"`
+			Data json.RawMessage `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Code != CodeOK {
+			t.Fatalf("%v: unexpected code %d", endpoint, r.Code)
+		}
+		return r.Data
+	}
+
+	var fetched struct {
+		TaskID float64 `json:"taskId"`
+	}
+	err = json.Unmarshal(post("fetch_task", nil), &fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.TaskID <= 0 || fetched.TaskID > models.MaxSafeTaskID {
+		t.Fatalf("unexpected task ID: %v", fetched.TaskID)
+	}
+	post("submit_task", url.Values{
+		"taskId":   {strconv.FormatFloat(fetched.TaskID, 'f', -1, 64)},
+		"feedback": {"1"},
+		"msg":      {"failed"},
+	})
+
+	err = testDB.First(legacy, legacy.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.State != models.TSQueued {
+		t.Errorf("the legacy task is assigned: %+v", legacy)
+	}
+	err = testDB.Delete(legacy).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitTasksProcessed(t)
+}
+
+// dialTestSocket connects to [WorkerSocket] as the worker, [read] returns the next message from the master
+func dialTestSocket(t *testing.T, w *fakeworker.Worker) (conn *websocket.Conn, read func() workerMessage) {
+	header := http.Header{}
+	header.Set("WS-Worker-ID", w.ID)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(w.Master, "http")+"/v1/worker/socket", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read = func() workerMessage {
+		var msg workerMessage
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	return conn, read
+}
+
+func getTestTask(t *testing.T, hexID string) *models.Task {
+	tid, err := strconv.ParseInt(hexID, 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var task models.Task
+	err = testDB.First(&task, tid).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &task
+}
+
+// TestWorkerSocket runs tasks pushed over the socket, they share the queue and the lease with the HTTP API
+func TestWorkerSocket(t *testing.T) {
+	user, notification, cleanup := newTestUser(t, "socket@example.com")
+	defer cleanup()
+
+	w, closeServer := newTestWorker(nil)
+	defer closeServer()
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, read := dialTestSocket(t, w)
+	defer conn.Close()
+
+	// the slots are taken until tasks are pushed
+	for i := 0; i <= maxSocketSlots; i++ {
+		err = conn.WriteJSON(&workerMessage{Type: "ready"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg := read(); msg.Type != "error" || msg.Code != CodeExceededLimits {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// pushed as soon as it is queued
+	cancelled := newTestSentry(t, user.ID, notification.ID, "cancelled", "https://cancelled.example.com/")
+	scheduleSentryTasks()
+	msg := read()
+	if msg.Type != "task" || msg.Task == nil || msg.Task.URL != "https://cancelled.example.com/" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	task := getTestTask(t, msg.TaskID)
+	if task.State != models.TSAssigned || task.WorkerID != models.SharedKeyWorkerPrefix+w.ID {
+		t.Fatalf("unexpected task: %+v", task)
+	}
+
+	// the heartbeat extends the lease
+	err = testDB.Model(task).Update("expire_at", time.Now().Add(time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.WriteJSON(&workerMessage{Type: "heartbeat", TaskID: msg.TaskID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := read(); msg.Type != "heartbeat" || msg.Cancelled == nil || *msg.Cancelled {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if task := getTestTask(t, msg.TaskID); task.ExpireAt.Before(time.Now().Add(taskLease / 2)) {
+		t.Errorf("the lease is not extended: %v", task.ExpireAt)
+	}
+
+	// the worker is told to stop once the task is cancelled
+	err = models.Transaction(func(tx models.TX) error {
+		return tx.CancelSentryTasks(cancelled)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.WriteJSON(&workerMessage{Type: "heartbeat", TaskID: msg.TaskID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := read(); msg.Type != "heartbeat" || msg.Cancelled == nil || !*msg.Cancelled {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	err = testDB.Delete(task).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a task of a disconnected worker is requeued once its lease expires
+	newTestSentry(t, user.ID, notification.ID, "disconnected", "https://disconnected.example.com/")
+	scheduleSentryTasks()
+	msg = read()
+	if msg.Type != "task" || msg.Task == nil || msg.Task.URL != "https://disconnected.example.com/" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	err = conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// until the master notices it
+	time.Sleep(100 * time.Millisecond)
+
+	err = testDB.Model(&models.Task{}).Where("1 = 1").Update("expire_at", time.Now()).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	requeueExpiredTasks()
+	// the slots left are not used after the disconnection
+	time.Sleep(100 * time.Millisecond)
+	if task := getTestTask(t, msg.TaskID); task.State != models.TSQueued {
+		t.Fatalf("unexpected task: %+v", task)
+	}
+	ok, err := w.RunOnce()
+	if err != nil || !ok {
+		t.Fatalf("the task is not run again: %v %v", ok, err)
+	}
+	waitTasksProcessed(t)
+}
+
+// TestCompareImages checks that SSIM and dHash ignore jitter that the mean difference reports, while all of them
+// detect a real change.
+func TestCompareImages(t *testing.T) {
+	draw := func(f func(x int, y int) color.NRGBA) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				img.SetNRGBA(x, y, f(x, y))
+			}
+		}
+		return img
+	}
+	gradient := func(x int, y int) color.NRGBA {
+		return color.NRGBA{R: uint8(x * 4), G: uint8(y * 5), B: 128, A: 255}
+	}
+	base := draw(gradient)
+	jitter := draw(func(x int, y int) color.NRGBA {
+		c := gradient(x, y)
+		d := uint8((x+y)%2) * 2
+		return color.NRGBA{R: c.R + d, G: c.G + d, B: c.B - d, A: 255}
+	})
+	changed := draw(func(x int, y int) color.NRGBA {
+		if x >= 16 && x < 48 && y >= 12 && y < 36 {
+			return color.NRGBA{A: 255}
+		}
+		return gradient(x, y)
+	})
+
+	for _, algorithm := range []string{models.AlgorithmMeanDifference, models.AlgorithmSSIM, models.AlgorithmDHash} {
+		trigger := &models.Trigger{}
+		trigger.SetAlgorithm(algorithm)
+		for _, c := range []struct {
+			name    string
+			img     image.Image
+			changed bool
+		}{
+			{"same", base, false},
+			{"jitter", jitter, algorithm == models.AlgorithmMeanDifference},
+			{"changed", changed, true},
+		} {
+			similarity, isChanged, err := compareImages(trigger, base, c.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isChanged != c.changed || similarity < 0 || similarity > 1 {
+				t.Errorf("%v %v: similarity %v, changed %v", algorithm, c.name, similarity, isChanged)
+			}
+		}
+
+		// the change is ignored
+		trigger.Masks = []models.Rect{{X: 10, Y: 10, Width: 40, Height: 30}}
+		similarity, isChanged, err := compareImages(trigger, base, changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isChanged {
+			t.Errorf("%v masked: similarity %v, changed %v", algorithm, similarity, isChanged)
+		}
+	}
+
+	// the jitter is below the tolerance of the diff
+	for _, c := range []struct {
+		img     image.Image
+		regions []image.Rectangle
+	}{
+		{jitter, nil},
+		{changed, []image.Rectangle{image.Rect(16, 0, 48, 48)}},
+	} {
+		_, regions, err := utils.ImageDiff(base, c.img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(regions) != fmt.Sprint(c.regions) {
+			t.Errorf("unexpected regions: %v", regions)
+		}
+	}
+}
+
+// TestSentrySizeChange checks both size policies when the page becomes shorter than the clip
+func TestSentrySizeChange(t *testing.T) {
+	emails, restore := captureEmails()
+	defer restore()
+	user, notification, cleanup := newTestUser(t, "size@example.com")
+	defer cleanup()
+
+	newTestSentryTask(t, user.ID, notification.ID, "pad", newTestClipTask("https://pad.example.com/"),
+		`{"similarityThreshold":0.9999,"sizePolicy":"pad"}`)
+	newTestSentryTask(t, user.ID, notification.ID, "change", newTestClipTask("https://change.example.com/"),
+		`{"similarityThreshold":0.9999,"sizePolicy":"change"}`)
+
+	w, closeServer := newTestWorker(fakeworker.Script{
+		"https://pad.example.com/":    {Behavior: fakeworker.ResizedAfter, After: 1},
+		"https://change.example.com/": {Behavior: fakeworker.ResizedAfter, After: 1},
+	})
+	defer closeServer()
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestChecks(t, w, 2, 2)
+
+	subjects, bodies := emails()
+	if len(subjects) != 2 {
+		t.Fatalf("unexpected notifications: %v", subjects)
+	}
+	for i, body := range bodies {
+		if !strings.Contains(body, "Size changed: 40x30 → 40x15") {
+			t.Errorf("the size change is not notified: %v", body)
+		}
+		zero := strings.Contains(body, "Similarity: 0.00%")
+		if zero != strings.HasSuffix(subjects[i], "change: change detected") {
+			t.Errorf("unexpected similarity of %v: %v", subjects[i], body)
+		}
+	}
+}
+
+func newTestTextSentry(t *testing.T, userID int64, notificationID int64, name string, url string,
+	trigger string) int64 {
+	return newTestSentryTask(t, userID, notificationID, name, &models.TaskSpec{
+		Schema:   models.TaskSchema,
+		Type:     models.TaskTypeText,
+		URL:      url,
+		Timeout:  40000,
+		Viewport: models.Viewport{Width: 900},
+		Selector: "li.news",
+		Extract:  models.ExtractText,
+	}, trigger)
+}
+
+func TestSentryText(t *testing.T) {
+	emails, restore := captureEmails()
+	defer restore()
+	user, notification, cleanup := newTestUser(t, "text@example.com")
+	defer cleanup()
+
+	newTestTextSentry(t, user.ID, notification.ID, "text", "https://text.example.com/",
+		`{"similarityThreshold":0.9999}`)
+
+	w, closeServer := newTestWorker(fakeworker.Script{
+		"https://text.example.com/": {Behavior: fakeworker.ChangedAfter, After: 2},
+	})
+	defer closeServer()
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first check saves the text, the second one is unchanged
+	runTestChecks(t, w, 3, 1)
+
+	subjects, bodies := emails()
+	if len(subjects) != 1 {
+		t.Fatalf("unexpected notifications: %v", subjects)
+	}
+	body := bodies[0]
+	for _, s := range []string{"li.news item 6", "li.news item 1", "Similarity: 80.00%"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%q is not notified: %v", s, body)
+		}
+	}
+	if strings.Contains(body, "li.news item 3") || strings.Contains(body, "get_history_image") {
+		t.Errorf("unexpected content: %v", body)
+	}
+}
+
+func TestNotifiedLines(t *testing.T) {
+	size := 0
+	lines := notifiedLines([]string{"a", strings.Repeat("é", maxNotifiedLineLength+1)}, &size)
+	if len(lines) != 2 || lines[0] != "a" || lines[1] != strings.Repeat("é", maxNotifiedLineLength)+"..." {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	many := make([]string, 100)
+	for i := range many {
+		many[i] = strings.Repeat("a", maxNotifiedLineLength)
+	}
+	size = 0
+	lines = notifiedLines(many, &size)
+	if len(lines) != maxNotifiedLines+1 || lines[maxNotifiedLines] != "... and 80 more" {
+		t.Errorf("unexpected lines: %v", lines[maxNotifiedLines:])
+	}
+	// the lines after are limited by the total size
+	lines = notifiedLines(many, &size)
+	if n := maxNotifiedTextSize/maxNotifiedLineLength - maxNotifiedLines; len(lines) != n+1 ||
+		lines[n] != fmt.Sprintf("... and %d more", 100-n) || size > maxNotifiedTextSize {
+		t.Errorf("unexpected lines: %v, size: %v", len(lines), size)
+	}
+}
+
+func TestSentryTextConditions(t *testing.T) {
+	emails, restore := captureEmails()
+	defer restore()
+	user, notification, cleanup := newTestUser(t, "conditions@example.com")
+	defer cleanup()
+
+	// the text changes from items 1-5 to items 2-6
+	newTestTextSentry(t, user.ID, notification.ID, "met", "https://met.example.com/",
+		`{"similarityThreshold":0.9999,"conditions":[{"type":"keywordAppears","keyword":"item 6"},`+
+			`{"type":"numberAbove","pattern":"item (\\d+)","value":1}]}`)
+	newTestTextSentry(t, user.ID, notification.ID, "any", "https://any.example.com/",
+		`{"similarityThreshold":0.9999,"combine":"any","conditions":[{"type":"keywordAppears","keyword":"item 9"},`+
+			`{"type":"keywordDisappears","keyword":"item 1\n"}]}`)
+	unmet := newTestTextSentry(t, user.ID, notification.ID, "unmet", "https://unmet.example.com/",
+		`{"similarityThreshold":0.9999,"conditions":[{"type":"regexMatches","pattern":"item [7-9]"}]}`)
+	// met at creation, it is notified by the first check but not again while it stays met
+	created := newTestTextSentry(t, user.ID, notification.ID, "created", "https://created.example.com/",
+		`{"similarityThreshold":0.9999,"conditions":[{"type":"keywordAppears","keyword":"item 3"}]}`)
+
+	w, closeServer := newTestWorker(fakeworker.Script{
+		"https://met.example.com/":     {Behavior: fakeworker.ChangedAfter, After: 1},
+		"https://any.example.com/":     {Behavior: fakeworker.ChangedAfter, After: 1},
+		"https://unmet.example.com/":   {Behavior: fakeworker.ChangedAfter, After: 1},
+		"https://created.example.com/": {Behavior: fakeworker.ChangedAfter, After: 1},
+	})
+	defer closeServer()
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestChecks(t, w, 2, 4)
+
+	subjects, bodies := emails()
+	if len(subjects) != 3 {
+		t.Fatalf("unexpected notifications: %v", subjects)
+	}
+	for i, body := range bodies {
+		var expected []string
+		if strings.HasSuffix(subjects[i], ": met: change detected") {
+			expected = []string{`keyword &#34;item 6&#34; appears: <b>item 6</b>`, `number above 1: <b>2</b>`}
+		} else if strings.HasSuffix(subjects[i], ": created: change detected") {
+			expected = []string{`keyword &#34;item 3&#34; appears: <b>item 3</b>`}
+		} else {
+			expected = []string{`keyword &#34;item 1\n&#34; disappears`}
+		}
+		for _, s := range expected {
+			if !strings.Contains(body, s) {
+				t.Errorf("%q is not notified: %v", s, body)
+			}
+		}
+	}
+
+	// the changed text is recorded without being notified
+	var sentry models.Sentry
+	err = testDB.First(&sentry, unmet).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions int64
+	err = testDB.Model(&models.SentryImage{}).Where("sentry_id = ?", unmet).Count(&versions).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sentry.NotifyCount != 0 || versions != 2 {
+		t.Errorf("unexpected sentry: %+v, versions: %d", sentry, versions)
+	}
+	var createdSentry models.Sentry
+	err = testDB.First(&createdSentry, created).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if createdSentry.NotifyCount != 1 {
+		t.Errorf("unexpected sentry: %+v", createdSentry)
+	}
+}
+
+func TestSentryCreateArea(t *testing.T) {
+	r := gin.New()
+	r.POST("/", SentryCreate)
+	for _, c := range []struct {
+		query string
+		code  int
+	}{
+		{"x=0&y=0&width=501&height=500", CodeAreaTooLarge},
+		{"x=0&y=0&width=4294967296&height=4294967296", CodeAreaTooLarge},
+		{"regions=" + url.QueryEscape(`[{"name":"a","x":0,"y":0,"width":501,"height":500}]`), CodeAreaTooLarge},
+		{"regions=" + url.QueryEscape(`[{"name":"a","x":0,"y":0,"width":4294967296,"height":4294967296}]`),
+			CodeAreaTooLarge},
+		{"regions=" + url.QueryEscape(`[{"name":"a","x":0,"y":0,"width":10,"height":10},`+
+			`{"name":"b","x":1000,"y":1000,"width":10,"height":10}]`), CodeAreaTooLarge},
+		{"regions=" + url.QueryEscape(`[{"name":"a","x":9223372036854775807,"y":0,"width":10,"height":10}]`),
+			CodeWrongParam},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/?url=https://example.com&notification=1&"+c.query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Code int `json:"code"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil || resp.Code != c.code {
+			t.Errorf("%v: unexpected response: %v %v", c.query, w.Body.String(), err)
+		}
+	}
+}
+
+func TestSentryRegions(t *testing.T) {
+	emails, restore := captureEmails()
+	defer restore()
+	user, notification, cleanup := newTestUser(t, "regions@example.com")
+	defer cleanup()
+
+	regions := []models.Region{
+		{Name: "a", Rect: models.Rect{X: 0, Y: 0, Width: 40, Height: 30}},
+		{Name: "b", Rect: models.Rect{X: 100, Y: 0, Width: 40, Height: 30}},
+		{Name: "c", Rect: models.Rect{X: 0, Y: 50, Width: 40, Height: 30}},
+	}
+	newTask := func(url string) *models.TaskSpec {
+		return &models.TaskSpec{
+			Schema:   models.TaskSchema,
+			URL:      url,
+			Timeout:  40000,
+			Clip:     models.RegionsClip(regions),
+			Viewport: models.Viewport{Width: 900},
+			Output:   models.TaskOutput{Type: "png"},
+			Regions:  regions,
+		}
+	}
+	newTestSentryTask(t, user.ID, notification.ID, "regions", newTask("https://regions.example.com/"),
+		`{"similarityThreshold":0.9999}`)
+	// the colors of the changed region are swapped, about 50% similar
+	newTestSentryTask(t, user.ID, notification.ID, "tolerant", newTask("https://tolerant.example.com/"),
+		`{"similarityThreshold":0.9999,"regionThresholds":{"b":{"similarityThreshold":0.4}}}`)
+
+	area := &models.Rect{X: 100, Y: 0, Width: 40, Height: 30}
+	w, closeServer := newTestWorker(fakeworker.Script{
+		"https://regions.example.com/":  {Behavior: fakeworker.ChangedAfter, After: 1, Area: area},
+		"https://tolerant.example.com/": {Behavior: fakeworker.ChangedAfter, After: 1, Area: area},
+	})
+	defer closeServer()
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestChecks(t, w, 2, 2)
+
+	subjects, bodies := emails()
+	if len(subjects) != 1 || !strings.HasSuffix(subjects[0], ": regions: change detected") {
+		t.Fatalf("unexpected notifications: %v", subjects)
+	}
+	if !strings.Contains(bodies[0], "<li>b (") || strings.Contains(bodies[0], "<li>a (") ||
+		strings.Contains(bodies[0], "<li>c (") {
+		t.Errorf("unexpected changed regions: %v", bodies[0])
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
@@ -17,7 +18,68 @@ import (
 	"github.com/websentry/websentry/utils"
 )
 
-func toggleNotification(sentryID int64, lasttime time.Time, old string, new string, similarity float32) error {
+// it is replaced in tests
+var sendEmail = utils.SendEmail
+
+// sentryChange is what is notified when a sentry detects a change
+type sentryChange struct {
+	beforeTime  time.Time
+	beforeImage string
+	afterImage  string
+	// the diff image with [regions] changed regions, empty if it couldn't be rendered
+	diffImage string
+	regions   int
+	// e.g. "900x300 → 900x250", empty if the size is the same
+	sizeChange string
+	// the changed regions with their similarity, e.g. "price (80.00%)"
+	changedRegions []string
+	// the lines added and removed by a text sentry
+	added   []string
+	removed []string
+	// the conditions of the trigger that are met
+	conditions []models.ConditionResult
+	similarity float32
+}
+
+// the limits of the text listed in a notification, so that it fits in the query string of ServerChan
+const (
+	maxNotifiedLines      = 20
+	maxNotifiedLineLength = 200  // in characters
+	maxNotifiedTextSize   = 4000 // of all the listed lines, in bytes
+)
+
+// notifiedLines returns at most [maxNotifiedLines] lines truncated to [maxNotifiedLineLength], with a note of how
+// many more there are. [size] is the size of the lines listed so far, they stop at [maxNotifiedTextSize].
+func notifiedLines(lines []string, size *int) []string {
+	var r []string
+	for i, line := range lines {
+		line = truncateLine(line)
+		if i == maxNotifiedLines || *size+len(line) > maxNotifiedTextSize {
+			return append(r, fmt.Sprintf("... and %d more", len(lines)-i))
+		}
+		*size += len(line)
+		r = append(r, line)
+	}
+	return r
+}
+
+// notifiedConditions returns the description and the value of the conditions truncated to [maxNotifiedLineLength]
+func notifiedConditions(results []models.ConditionResult) []gin.H {
+	var r []gin.H
+	for _, c := range results {
+		r = append(r, gin.H{"Condition": truncateLine(c.Condition.String()), "Value": truncateLine(c.Value)})
+	}
+	return r
+}
+
+func truncateLine(line string) string {
+	if utf8.RuneCountInString(line) <= maxNotifiedLineLength {
+		return line
+	}
+	return string([]rune(line)[:maxNotifiedLineLength]) + "..."
+}
+
+func toggleNotification(sentryID int64, change *sentryChange) error {
 	var nid int64
 	var name string
 	var n *models.NotificationMethod
@@ -57,14 +119,26 @@ func toggleNotification(sentryID int64, lasttime time.Time, old string, new stri
 		return err
 	}
 
-	data := map[string]string{
-		"name":        name,
-		"beforeTime":  lasttime.In(tz).Format("2006-01-02 15:04"),
-		"currentTime": time.Now().In(tz).Format("2006-01-02 15:04"),
-		"beforeImage": config.GetConfig().BackendURL + "v1/common/get_history_image?filename=" + old,
-		"afterImage":  config.GetConfig().BackendURL + "v1/common/get_history_image?filename=" + new,
-		"similarity":  fmt.Sprintf("%.2f%%", similarity*100),
-		"sentryUrl":   config.GetConfig().FrontendURL + "dashboard/sentry/" + strconv.FormatInt(sentryID, 16),
+	size := 0
+	data := map[string]interface{}{
+		"name":           name,
+		"beforeTime":     change.beforeTime.In(tz).Format("2006-01-02 15:04"),
+		"currentTime":    time.Now().In(tz).Format("2006-01-02 15:04"),
+		"similarity":     fmt.Sprintf("%.2f%%", change.similarity*100),
+		"sentryUrl":      config.GetConfig().FrontendURL + "dashboard/sentry/" + strconv.FormatInt(sentryID, 16),
+		"sizeChange":     change.sizeChange,
+		"added":          notifiedLines(change.added, &size),
+		"removed":        notifiedLines(change.removed, &size),
+		"conditions":     notifiedConditions(change.conditions),
+		"changedRegions": change.changedRegions,
+	}
+	if change.afterImage != "" {
+		data["beforeImage"] = config.GetConfig().BackendURL + "v1/common/get_history_image?filename=" + change.beforeImage
+		data["afterImage"] = config.GetConfig().BackendURL + "v1/common/get_history_image?filename=" + change.afterImage
+	}
+	if change.diffImage != "" {
+		data["diffImage"] = config.GetConfig().BackendURL + "v1/common/get_history_image?filename=" + change.diffImage
+		data["regions"] = strconv.Itoa(change.regions)
 	}
 
 	title := name + ": change detected"
@@ -109,7 +183,7 @@ func toggleNotification(sentryID int64, lasttime time.Time, old string, new stri
 		}
 
 		bs := b.String()
-		utils.SendEmail(nSetting["email"].(string), title, &bs)
+		sendEmail(nSetting["email"].(string), title, &bs)
 
 	}
 
@@ -17,6 +17,10 @@ const (
 	CodeAlreadyExist   = -6
 
 	CodeAreaTooLarge = -1001
+
+	CodeSentryNotRunning = -1101
+
+	CodeTaskNotAssignable = -1201
 )
 
 var msgMap = map[int]string{
@@ -32,6 +36,10 @@ var msgMap = map[int]string{
 	// specific
 	// create sentry
 	-1001: "Area too large",
+	// check sentry now
+	-1101: "Sentry is not running",
+	// submit task
+	-1201: "Task does not accept this result",
 }
 
 func JSONResponse(c *gin.Context, code int, detail string, data interface{}) {
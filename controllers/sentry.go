@@ -3,8 +3,11 @@ package controllers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"image"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/url"
 	"strconv"
 	"strings"
@@ -18,6 +21,15 @@ import (
 	"github.com/websentry/websentry/utils"
 )
 
+// the most worker tags a sentry can require
+const maxRequiredTags = 5
+
+// the largest area watched by a sentry, or by each of its regions
+const maxAreaSize = 500 * 500
+
+// the largest rectangle containing the regions of a sentry, they are taken in one screenshot
+const maxRegionsClipSize = 1000 * 1000
+
 // [url] the url of the page that needs screenshot
 func SentryRequestFullScreenshot(c *gin.Context) {
 	u, err := url.ParseRequestURI(c.Query("url"))
@@ -28,25 +40,30 @@ func SentryRequestFullScreenshot(c *gin.Context) {
 
 	// TODO: handle extreme long page
 
-	task := gin.H{
-		"url":      u.String(),
-		"timeout":  40000,
-		"fullPage": true,
-		"viewport": gin.H{
-			"width":    900,
-			"isMobile": false,
+	task := &models.TaskSpec{
+		Schema:   models.TaskSchema,
+		URL:      u.String(),
+		Timeout:  40000,
+		FullPage: true,
+		Viewport: models.Viewport{
+			Width:    900,
+			IsMobile: false,
 		},
-		"output": gin.H{
-			"type":        "jpg",
-			"progressive": true,
-			"quality":     20,
+		Output: models.TaskOutput{
+			Type:        "jpg",
+			Progressive: true,
+			Quality:     20,
 		},
 	}
 
-	id := addFullScreenshotTask(task, c.MustGet("userId").(int64))
+	id, err := addFullScreenshotTask(task, c.MustGet("userId").(int64))
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return
+	}
 
 	JSONResponse(c, CodeOK, "", gin.H{
-		"taskId": id,
+		"taskId": userTaskID(id),
 	})
 }
 
@@ -54,6 +71,49 @@ func SentryWaitFullScreenshot(c *gin.Context) {
 	waitFullScreenshot(c)
 }
 
+// SentryCheckNow checks the sentry without waiting for its next check time
+func SentryCheckNow(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Query("id"), 16, 64)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid sentry id", nil)
+		return
+	}
+
+	var s *models.Sentry
+	var image *models.SentryImage
+	err = models.Transaction(func(tx models.TX) (err error) {
+		s, image, err = tx.GetUserSentry(id, c.MustGet("userId").(int64))
+		return
+	})
+	if err != nil {
+		if models.IsErrNoDocument(err) {
+			JSONResponse(c, CodeNotExist, "", nil)
+		} else {
+			InternalErrorResponse(c, err)
+		}
+		return
+	}
+	// the result can't be recorded otherwise
+	if s.RunningState != models.RSRunning {
+		JSONResponse(c, CodeSentryNotRunning, "", nil)
+		return
+	}
+
+	tid, err := requestSentryCheck(s, image, c.MustGet("userId").(int64))
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return
+	}
+
+	JSONResponse(c, CodeOK, "", gin.H{
+		"taskId": userTaskID(tid),
+	})
+}
+
+func SentryWaitCheck(c *gin.Context) {
+	waitSentryCheck(c)
+}
+
 type SentryListItemJSON struct {
 	ID            string     `json:"id"`
 	Name          string     `json:"name"`
@@ -79,13 +139,12 @@ func SentryList(c *gin.Context) {
 		sentries[i].Name = results[i].Name
 		sentries[i].ID = strconv.FormatInt(results[i].ID, 16)
 
-		var task map[string]interface{}
-		err = errors.WithStack(json.Unmarshal([]byte(results[i].Task), &task))
+		task, err := models.ParseTaskSpec(results[i].Task)
 		if err != nil {
 			InternalErrorResponse(c, err)
 			return
 		}
-		sentries[i].URL = task["url"].(string)
+		sentries[i].URL = task.URL
 		sentries[i].RunningState = int(results[i].RunningState)
 		sentries[i].LastCheckTime = results[i].LastCheckTime
 	}
@@ -97,6 +156,7 @@ func SentryList(c *gin.Context) {
 
 type SentryImageJson struct {
 	File      string    `json:"file"`
+	DiffFile  string    `json:"diffFile"` // the changes from the previous image, served like the thumbs
 	CreatedAt time.Time `json:"createdAt"`
 }
 
@@ -107,17 +167,24 @@ type NotificationMethodJson struct {
 }
 
 type SentryJSON struct {
-	ID            string                 `json:"id"`
-	Name          string                 `json:"name"`
-	RunningState  int                    `json:"runningState"`
-	Notification  NotificationMethodJson `json:"notification"`
-	LastCheckTime *time.Time             `json:"lastCheckTime"`
-	Interval      int                    `json:"interval"`
-	CheckCount    int                    `json:"checkCount"`
-	NotifyCount   int                    `json:"notifyCount"`
-	ImageHistory  []SentryImageJson      `json:"imageHistory"`
-	Task          map[string]interface{} `json:"task"`
-	CreatedAt     time.Time              `json:"createdAt"`
+	ID                  string                 `json:"id"`
+	Name                string                 `json:"name"`
+	RunningState        int                    `json:"runningState"`
+	Notification        NotificationMethodJson `json:"notification"`
+	LastCheckTime       *time.Time             `json:"lastCheckTime"`
+	Interval            int                    `json:"interval"`
+	CheckCount          int                    `json:"checkCount"`
+	NotifyCount         int                    `json:"notifyCount"`
+	ImageHistory        []SentryImageJson      `json:"imageHistory"`
+	Task                *models.TaskSpec       `json:"task"`
+	CreatedAt           time.Time              `json:"createdAt"`
+	ConsecutiveFailures int                    `json:"consecutiveFailures"`
+	LastError           string                 `json:"lastError"`
+	LastErrorTime       *time.Time             `json:"lastErrorTime"`
+	Schedule            *models.Schedule       `json:"schedule"`
+	NextCheckTime       time.Time              `json:"nextCheckTime"`
+	RequiredTags        []string               `json:"requiredTags"`
+	Trigger             *models.Trigger        `json:"trigger"`
 }
 
 func SentryInfo(c *gin.Context) {
@@ -164,15 +231,41 @@ func SentryInfo(c *gin.Context) {
 	for i := range imageHistory {
 		imageHistoryJSON[i].CreatedAt = imageHistory[i].CreatedAt
 		imageHistoryJSON[i].File = imageHistory[i].File
+		imageHistoryJSON[i].DiffFile = imageHistory[i].DiffFile
 	}
 
-	var task map[string]interface{}
-	err = errors.WithStack(json.Unmarshal([]byte(s.Task), &task))
+	task, err := models.ParseTaskSpec(s.Task)
 	if err != nil {
 		InternalErrorResponse(c, err)
 		return
 	}
 
+	var schedule *models.Schedule
+	if s.Schedule != "" {
+		schedule = &models.Schedule{}
+		err = errors.WithStack(json.Unmarshal([]byte(s.Schedule), schedule))
+		if err != nil {
+			InternalErrorResponse(c, err)
+			return
+		}
+		if schedule.IsZero() {
+			schedule = nil
+		}
+	}
+
+	trigger := &models.Trigger{}
+	err = json.Unmarshal([]byte(s.Trigger), trigger)
+	if err != nil {
+		InternalErrorResponse(c, errors.WithStack(err))
+		return
+	}
+	trigger.Algorithm = trigger.GetAlgorithm()
+
+	requiredTags := []string{}
+	if s.RequiredTags != "" {
+		requiredTags = strings.Split(s.RequiredTags, ",")
+	}
+
 	notificationJson := NotificationMethodJson{
 		strconv.FormatInt(notification.ID, 16),
 		notification.Name,
@@ -184,12 +277,178 @@ func SentryInfo(c *gin.Context) {
 		notificationJson, s.LastCheckTime,
 		s.Interval, s.CheckCount, s.NotifyCount,
 		imageHistoryJSON, task, s.CreatedAt,
+		s.ConsecutiveFailures, s.LastError, s.LastErrorTime,
+		schedule, s.NextCheckTime,
+		requiredTags, trigger,
 	}
 
 	JSONResponse(c, CodeOK, "", sentryJSON)
 
 }
 
+// parseSchedule reads the schedule from [cron] or [windowStart], [windowEnd] and [weekdays] (e.g. "1,2,3,4,5").
+// [ok] is false if none of them is provided.
+func parseSchedule(c *gin.Context) (schedule models.Schedule, ok bool, err error) {
+	var provided bool
+	schedule.Cron, provided = c.GetQuery("cron")
+	ok = ok || provided
+	schedule.WindowStart, provided = c.GetQuery("windowStart")
+	ok = ok || provided
+	schedule.WindowEnd, provided = c.GetQuery("windowEnd")
+	ok = ok || provided
+
+	weekdays, provided := c.GetQuery("weekdays")
+	ok = ok || provided
+	if weekdays != "" {
+		for _, d := range strings.Split(weekdays, ",") {
+			var day int
+			day, err = strconv.Atoi(strings.TrimSpace(d))
+			if err != nil {
+				return
+			}
+			schedule.Weekdays = append(schedule.Weekdays, day)
+		}
+	}
+
+	if ok {
+		err = schedule.Validate()
+	}
+	return
+}
+
+// parseRequiredTags reads [tags], comma separated tags that a worker must have to check the sentry
+func parseRequiredTags(c *gin.Context) (tags []string, ok bool, err error) {
+	s, ok := c.GetQuery("tags")
+	if !ok {
+		return
+	}
+	tags, err = models.ParseTags(s)
+	if err == nil && len(tags) > maxRequiredTags {
+		err = errors.New("too many tags")
+	}
+	return
+}
+
+// triggerParams are the fields of the trigger provided in a request, nil ones are kept
+type triggerParams struct {
+	algorithm           *string
+	similarityThreshold *float64
+	ssimThreshold       *float64
+	hashDistance        *int
+	sizePolicy          *string
+	masks               *[]models.Rect
+	conditions          *[]models.Condition
+	combine             *string
+	regionThresholds    *map[string]models.RegionThreshold
+}
+
+// parseTriggerParams reads [algorithm], [similarityThreshold], [ssimThreshold], [hashDistance], [sizePolicy],
+// [masks] (json, e.g. `[{"x":0,"y":0,"width":60,"height":20}]`, empty to remove them), [conditions] (json, e.g.
+// `[{"type":"numberBelow","pattern":"Price: ([0-9.,]+)","value":100}]`, empty to remove them), [combine] and
+// [regionThresholds] (json, e.g. `{"price":{"similarityThreshold":0.99}}`, empty to remove them).
+// [ok] is false if none of them is provided.
+func parseTriggerParams(c *gin.Context) (p triggerParams, ok bool, err error) {
+	if s, provided := c.GetQuery("algorithm"); provided {
+		ok = true
+		p.algorithm = &s
+	}
+	for name, v := range map[string]**float64{
+		"similarityThreshold": &p.similarityThreshold,
+		"ssimThreshold":       &p.ssimThreshold,
+	} {
+		if s, provided := c.GetQuery(name); provided {
+			ok = true
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return p, ok, errors.WithStack(err)
+			}
+			*v = &f
+		}
+	}
+	if s, provided := c.GetQuery("hashDistance"); provided {
+		ok = true
+		d, err := strconv.Atoi(s)
+		if err != nil {
+			return p, ok, errors.WithStack(err)
+		}
+		p.hashDistance = &d
+	}
+	if s, provided := c.GetQuery("sizePolicy"); provided {
+		ok = true
+		p.sizePolicy = &s
+	}
+	if s, provided := c.GetQuery("masks"); provided {
+		ok = true
+		masks := []models.Rect{}
+		if s != "" {
+			err = errors.WithStack(json.Unmarshal([]byte(s), &masks))
+			if err != nil {
+				return
+			}
+		}
+		p.masks = &masks
+	}
+	if s, provided := c.GetQuery("conditions"); provided {
+		ok = true
+		conditions := []models.Condition{}
+		if s != "" {
+			err = errors.WithStack(json.Unmarshal([]byte(s), &conditions))
+			if err != nil {
+				return
+			}
+		}
+		p.conditions = &conditions
+	}
+	if s, provided := c.GetQuery("combine"); provided {
+		ok = true
+		p.combine = &s
+	}
+	if s, provided := c.GetQuery("regionThresholds"); provided {
+		ok = true
+		thresholds := map[string]models.RegionThreshold{}
+		if s != "" {
+			err = errors.WithStack(json.Unmarshal([]byte(s), &thresholds))
+			if err != nil {
+				return
+			}
+		}
+		p.regionThresholds = &thresholds
+	}
+	return
+}
+
+// apply updates the trigger with the params and validates it
+func (p *triggerParams) apply(trigger *models.Trigger) error {
+	if p.algorithm != nil {
+		trigger.SetAlgorithm(*p.algorithm)
+	}
+	if p.similarityThreshold != nil {
+		trigger.SimilarityThreshold = *p.similarityThreshold
+	}
+	if p.ssimThreshold != nil {
+		trigger.SSIMThreshold = *p.ssimThreshold
+	}
+	if p.hashDistance != nil {
+		trigger.HashDistance = *p.hashDistance
+	}
+	if p.sizePolicy != nil {
+		trigger.SizePolicy = *p.sizePolicy
+	}
+	if p.masks != nil {
+		trigger.Masks = *p.masks
+	}
+	if p.conditions != nil {
+		trigger.Conditions = *p.conditions
+	}
+	if p.combine != nil {
+		trigger.Combine = *p.combine
+	}
+	if p.regionThresholds != nil {
+		trigger.RegionThresholds = *p.regionThresholds
+	}
+	return trigger.Validate()
+}
+
 // SentryCreate creates a new sentry
 func SentryCreate(c *gin.Context) {
 	u, err := url.ParseRequestURI(c.Query("url"))
@@ -205,33 +464,117 @@ func SentryCreate(c *gin.Context) {
 		return
 	}
 
-	x, _ := strconv.ParseInt(c.Query("x"), 10, 32)
-	y, _ := strconv.ParseInt(c.Query("y"), 10, 32)
-	width, _ := strconv.ParseInt(c.Query("width"), 10, 32)
-	height, _ := strconv.ParseInt(c.Query("height"), 10, 32)
+	task := &models.TaskSpec{
+		Schema:   models.TaskSchema,
+		Type:     c.Query("type"),
+		URL:      u.String(),
+		Timeout:  40000,
+		FullPage: false,
+		Viewport: models.Viewport{
+			Width:    900,
+			IsMobile: false,
+		},
+	}
+
+	switch task.GetType() {
+	case models.TaskTypeScreenshot:
+		// either [regions] or one area
+		if regions := c.Query("regions"); regions != "" {
+			err = json.Unmarshal([]byte(regions), &task.Regions)
+			if err != nil || len(task.Regions) > models.MaxRegions {
+				JSONResponse(c, CodeWrongParam, "Invalid regions", nil)
+				return
+			}
+			// the sizes are divided instead of multiplied, they can be as large as an int
+			for _, r := range task.Regions {
+				if !(r.X >= 0 && r.Y >= 0 && r.X <= math.MaxInt32 && r.Y <= math.MaxInt32 && r.Width > 0 &&
+					r.Height > 0) {
+					JSONResponse(c, CodeWrongParam, "Invalid regions", nil)
+					return
+				}
+				if r.Width > maxAreaSize/r.Height {
+					JSONResponse(c, CodeAreaTooLarge, "", nil)
+					return
+				}
+			}
+			task.Clip = models.RegionsClip(task.Regions)
+			if task.Clip == nil {
+				JSONResponse(c, CodeWrongParam, "Invalid regions", nil)
+				return
+			}
+			if task.Clip.Width > maxRegionsClipSize/task.Clip.Height {
+				JSONResponse(c, CodeAreaTooLarge, "", nil)
+				return
+			}
+		} else {
+			x, _ := strconv.ParseInt(c.Query("x"), 10, 32)
+			y, _ := strconv.ParseInt(c.Query("y"), 10, 32)
+			width, _ := strconv.ParseInt(c.Query("width"), 10, 32)
+			height, _ := strconv.ParseInt(c.Query("height"), 10, 32)
+
+			if !(x >= 0 && y >= 0 && width > 0 && height > 0) {
+				JSONResponse(c, CodeWrongParam, "Invalid area", nil)
+				return
+			}
+
+			if width > maxAreaSize/height {
+				JSONResponse(c, CodeAreaTooLarge, "", nil)
+				return
+			}
 
-	if !(x >= 0 && y >= 0 && width > 0 && height > 0) {
-		JSONResponse(c, CodeWrongParam, "Invalid area", nil)
+			task.Clip = &models.Rect{
+				X:      int(x),
+				Y:      int(y),
+				Width:  int(width),
+				Height: int(height),
+			}
+		}
+		task.Output = models.TaskOutput{
+			Type: "png",
+		}
+	case models.TaskTypeText:
+		task.Selector = c.Query("selector")
+		task.Extract = c.DefaultQuery("extract", models.ExtractText)
+	default:
+		JSONResponse(c, CodeWrongParam, "Invalid type", nil)
 		return
 	}
-
-	if width*height > 500*500 {
-		JSONResponse(c, CodeAreaTooLarge, "", nil)
+	if task.Validate() != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid task", nil)
 		return
 	}
 
-	similarityThreshold, err := strconv.ParseFloat(c.DefaultQuery("similarityThreshold", "0.9999"), 64)
-	if err != nil || similarityThreshold <= 0 || similarityThreshold > 1 {
-		JSONResponse(c, CodeWrongParam, "Invalid similarityThreshold", nil)
+	trigger := models.Trigger{
+		Algorithm:           models.AlgorithmMeanDifference,
+		SimilarityThreshold: models.DefaultSimilarityThreshold,
+	}
+	triggerParams, _, err := parseTriggerParams(c)
+	if err == nil {
+		err = triggerParams.apply(&trigger)
+	}
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid trigger", nil)
 		return
 	}
 
 	interval, err := strconv.Atoi(c.DefaultQuery("interval", "240")) // 4 hours
-	if err != nil || interval < 15 {
+	if err != nil || interval < models.MinCheckInterval {
 		JSONResponse(c, CodeWrongParam, "Invalid interval", nil)
 		return
 	}
 
+	schedule, hasSchedule, err := parseSchedule(c)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid schedule", nil)
+		return
+	}
+
+	tags, _, err := parseRequiredTags(c)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid tags", nil)
+		return
+	}
+
 	s := &models.Sentry{}
 	s.Name = c.Query("name")
 	s.RunningState = models.RSRunning
@@ -239,42 +582,34 @@ func SentryCreate(c *gin.Context) {
 	s.NotificationID = notification
 	s.NextCheckTime = time.Now()
 	s.Interval = interval
+	s.RequiredTags = models.NormalizeTags(tags)
 	s.CheckCount = 0
 	s.NotifyCount = 0
 
-	trigger := models.Trigger{SimilarityThreshold: similarityThreshold}
-	triggerJSON, err := json.Marshal(&trigger)
+	if hasSchedule && !schedule.IsZero() {
+		scheduleJSON, err := json.Marshal(&schedule)
+		if err != nil {
+			InternalErrorResponse(c, errors.WithStack(err))
+			return
+		}
+		s.Schedule = string(scheduleJSON)
+	}
+
+	s.Task, err = task.JSON()
 	if err != nil {
-		InternalErrorResponse(c, errors.WithStack(err))
+		InternalErrorResponse(c, err)
 		return
 	}
-	s.Trigger = string(triggerJSON)
 
-	task := gin.H{
-		"url":      u.String(),
-		"timeout":  40000,
-		"fullPage": false,
-		"clip": gin.H{
-			"x":      int(x),
-			"width":  int(width),
-			"height": int(height),
-			"y":      int(y),
-		},
-		"viewport": gin.H{
-			"width":    900,
-			"isMobile": false,
-		},
-		"output": gin.H{
-			"type": "png",
-		},
+	if trigger.ValidateTask(task) != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid trigger", nil)
+		return
 	}
-
-	taskJSON, err := json.Marshal(&task)
+	s.Trigger, err = trigger.JSON()
 	if err != nil {
-		InternalErrorResponse(c, errors.WithStack(err))
+		InternalErrorResponse(c, err)
 		return
 	}
-	s.Task = string(taskJSON)
 
 	var sid int64
 	err = models.Transaction(func(tx models.TX) (err error) {
@@ -307,31 +642,49 @@ func SentryUpdate(c *gin.Context) {
 
 	action := false
 
-	similarityThresholdStr, ok := c.GetQuery("similarityThreshold")
+	// the provided fields are merged into the current trigger
+	triggerParams, hasTrigger, err := parseTriggerParams(c)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid trigger", nil)
+		return
+	}
+	if hasTrigger {
+		action = true
+	}
+
+	intervalStr, ok := c.GetQuery("interval")
 	if ok {
 		action = true
-		similarityThreshold, err := strconv.ParseFloat(similarityThresholdStr, 64)
-		if err != nil || similarityThreshold <= 0 || similarityThreshold > 1 {
-			JSONResponse(c, CodeWrongParam, "Invalid similarityThreshold", nil)
+		sentry.Interval, err = strconv.Atoi(intervalStr)
+		if err != nil || sentry.Interval < models.MinCheckInterval {
+			JSONResponse(c, CodeWrongParam, "Invalid interval", nil)
 			return
 		}
-		trigger := models.Trigger{SimilarityThreshold: similarityThreshold}
-		triggerJSON, err := json.Marshal(&trigger)
+	}
+
+	// the whole schedule is replaced, providing empty values goes back to the plain interval
+	schedule, ok, err := parseSchedule(c)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid schedule", nil)
+		return
+	}
+	if ok {
+		action = true
+		scheduleJSON, err := json.Marshal(&schedule)
 		if err != nil {
 			InternalErrorResponse(c, errors.WithStack(err))
 			return
 		}
-		sentry.Trigger = string(triggerJSON)
+		sentry.Schedule = string(scheduleJSON)
 	}
 
-	intervalStr, ok := c.GetQuery("interval")
-	if ok {
+	tags, hasTags, err := parseRequiredTags(c)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "Invalid tags", nil)
+		return
+	}
+	if hasTags {
 		action = true
-		sentry.Interval, err = strconv.Atoi(intervalStr)
-		if err != nil || sentry.Interval < 15 {
-			JSONResponse(c, CodeWrongParam, "Invalid interval", nil)
-			return
-		}
 	}
 
 	name, ok := c.GetQuery("name")
@@ -370,6 +723,39 @@ func SentryUpdate(c *gin.Context) {
 	}
 
 	err = models.Transaction(func(tx models.TX) (err error) {
+		if hasTrigger {
+			s, _, err := tx.GetUserSentry(id, c.MustGet("userId").(int64))
+			if err != nil {
+				return err
+			}
+			trigger := models.Trigger{}
+			err = json.Unmarshal([]byte(s.Trigger), &trigger)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			err = triggerParams.apply(&trigger)
+			if err != nil {
+				return err
+			}
+			task, err := models.ParseTaskSpec(s.Task)
+			if err != nil {
+				return err
+			}
+			err = trigger.ValidateTask(task)
+			if err != nil {
+				return err
+			}
+			sentry.Trigger, err = trigger.JSON()
+			if err != nil {
+				return err
+			}
+		}
+		if hasTags {
+			err = tx.UpdateSentryRequiredTags(id, c.MustGet("userId").(int64), tags)
+			if err != nil {
+				return
+			}
+		}
 		return tx.UpdateSentry(id, c.MustGet("userId").(int64), &sentry)
 	})
 	if err != nil {
@@ -381,6 +767,10 @@ func SentryUpdate(c *gin.Context) {
 			JSONResponse(c, CodeWrongParam, "notification does not exist", nil)
 			return
 		}
+		if errors.Is(err, models.ErrInvalidTrigger) {
+			JSONResponse(c, CodeWrongParam, "Invalid trigger", nil)
+			return
+		}
 		InternalErrorResponse(c, err)
 		return
 	}
@@ -427,54 +817,266 @@ func GetHistoryImage(c *gin.Context) {
 	}
 }
 
+// GetHistoryText returns a version of the text of a text sentry
+func GetHistoryText(c *gin.Context) {
+	filename := c.Query("filename")
+	// filename is unsafe
+	if utils.ImageCheckFilename(filename) {
+		text, err := utils.TextRead(filename)
+		if err != nil {
+			c.String(404, "")
+		} else {
+			c.Data(200, "text/plain; charset=utf-8", []byte(text))
+		}
+	} else {
+		c.String(404, "")
+	}
+}
+
 func sentryTaskScheduler() {
 	for {
 		time.Sleep(2 * time.Minute)
+		scheduleSentryTasks()
+	}
+}
 
-		for {
-			var sentry *models.Sentry
-			var image *models.SentryImage
-			err := models.Transaction(func(tx models.TX) (err error) {
-				sentry, image, err = tx.GetUncheckedSentry()
+// scheduleSentryTasks adds a task for each sentry that is due
+func scheduleSentryTasks() {
+	for {
+		var sentry *models.Sentry
+		var image *models.SentryImage
+		var queued int64
+		err := models.Transaction(func(tx models.TX) (err error) {
+			// leave the rest to the next round if workers can't keep up
+			queued, err = tx.CountQueuedTasks()
+			if err != nil || queued >= queueBuffer {
 				return
-			})
-			if err != nil {
-				// TODO: log
-				break
 			}
-			if sentry == nil {
-				break
-			}
-			// add task
+			sentry, image, err = tx.GetUncheckedSentry()
+			return
+		})
+		if err != nil {
 			// TODO: log
-			_, _ = addSentryTask(sentry, image)
+			break
+		}
+		if sentry == nil {
+			break
+		}
+		// add task
+		_, err = addSentryTask(sentry, image)
+		if err != nil {
+			log.Printf("[sentryTaskScheduler] Error occurred in sentry: %x, err: %+v", sentry.ID, err)
 		}
 	}
 }
 
-func compareSentryTaskImage(tid int32, ti *taskInfo) error {
+// processSentryTask handles the result of a sentry task and removes the task afterwards
+func processSentryTask(t *models.Task) {
+	var claimed bool
+	err := models.Transaction(func(tx models.TX) (err error) {
+		claimed, err = tx.ClaimTaskResult(t.ID, taskLease)
+		return
+	})
+	if err != nil {
+		log.Printf("[processSentryTask] Error occurred in task: %d, err: %+v", t.ID, err)
+		return
+	}
+	if !claimed {
+		// processed by others
+		return
+	}
+
+	var similarity *float64
+	var changed bool
+	errMsg := ""
 	defer func() {
-		// clean up
-		taskq.infoMux.Lock()
-		delete(taskq.info, tid)
-		taskq.infoMux.Unlock()
+		// clean up, the result is kept for a while if a user is waiting for it
+		err := models.Transaction(func(tx models.TX) error {
+			if t.UserID != 0 {
+				return tx.FinishSentryTaskProcessing(t.ID, similarity, changed, errMsg, sentryCheckRetention)
+			}
+			return tx.DeleteTask(t.ID)
+		})
+		if err != nil {
+			log.Printf("[processSentryTask] Error occurred in task: %d, err: %+v", t.ID, err)
+		}
+		utils.TaskResultDelete(t.ID)
+		if t.UserID != 0 {
+			notifyTaskDone(t.ID)
+		}
 	}()
 
-	b, err := imaging.Decode(bytes.NewReader(ti.image))
+	if t.State == models.TSFailed {
+		log.Printf("[processSentryTask] Info: sentry: %x, task failed, feedback: %d, msg: %v \n",
+			t.SentryID, t.FeedbackCode, t.FeedbackMsg)
+		recordSentryFailure(t.SentryID, fmt.Sprintf("worker feedback %d: %s", t.FeedbackCode, t.FeedbackMsg))
+		return
+	}
+
+	task, err := models.ParseTaskSpec(t.Task)
+	if err == nil {
+		if task.GetType() == models.TaskTypeText {
+			similarity, changed, err = compareSentryTaskText(t)
+		} else {
+			similarity, changed, err = compareSentryTaskImage(t)
+		}
+	}
+	if err != nil {
+		log.Printf("[processSentryTask] Error occurred in task: %d, err: %v", t.ID, err)
+		errMsg = err.Error()
+		recordSentryFailure(t.SentryID, errMsg)
+	}
+}
+
+// recordSentryFailure schedules a retry of the failed check, the sentry is paused if it keeps failing
+func recordSentryFailure(sentryID int64, msg string) {
+	var paused bool
+	err := models.Transaction(func(tx models.TX) (err error) {
+		paused, err = tx.UpdateSentryAfterFailure(sentryID, msg)
+		return
+	})
+	if err != nil {
+		if !errors.Is(err, models.ErrSentryNotRunning) {
+			log.Printf("[recordSentryFailure] Error occurred in sentry: %x, err: %+v", sentryID, err)
+		}
+		return
+	}
+	if paused {
+		log.Printf("[recordSentryFailure] Info: sentry: %x is paused after %d consecutive failures \n",
+			sentryID, models.MaxConsecutiveFailures)
+	}
+}
+
+// compareImages compares the images with the algorithm of the trigger, ignoring its masks. [similarity] is between
+// 0 and 1 for every algorithm (SSIM is clamped), so that it can be recorded and notified the same way.
+func compareImages(trigger *models.Trigger, a image.Image, b image.Image) (similarity float64, changed bool, err error) {
+	masks := trigger.MaskRectangles()
+	if trigger.GetAlgorithm() != models.AlgorithmMeanDifference {
+		a, b = utils.ImageFillMasks(a, masks), utils.ImageFillMasks(b, masks)
+	}
+
+	switch trigger.GetAlgorithm() {
+	case models.AlgorithmSSIM:
+		similarity, err = utils.ImageSSIM(a, b)
+		if err != nil {
+			return
+		}
+		similarity = math.Max(similarity, 0)
+		changed = similarity < trigger.SSIMThreshold
+	case models.AlgorithmDHash:
+		distance := utils.ImageHashDistance(a, b)
+		similarity = 1 - float64(distance)/models.HashBits
+		changed = distance > trigger.HashDistance
+	default:
+		var s float32
+		s, err = utils.ImageCompare(a, b, masks)
+		similarity = float64(s)
+		changed = similarity < trigger.SimilarityThreshold
+	}
+	return
+}
+
+// compareRegions compares each region of the task with its own thresholds, [similarity] is the lowest one. It returns
+// the areas of the changed regions in the images and describes them for the notification.
+func compareRegions(trigger *models.Trigger, task *models.TaskSpec, a image.Image, b image.Image) (similarity float64,
+	changed []image.Rectangle, descriptions []string, err error) {
+	similarity = 1
+	for _, r := range task.Regions {
+		rect := task.RegionRectangle(r)
+		// the images can be smaller than the clip if the page is shorter, the region is cut or missing in both
+		rect = rect.Intersect(a.Bounds())
+		if rect.Empty() {
+			continue
+		}
+		s, c, err := compareImages(trigger.ForRegion(task, r), imaging.Crop(a, rect), imaging.Crop(b, rect))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		similarity = math.Min(similarity, s)
+		if c {
+			changed = append(changed, rect)
+			descriptions = append(descriptions, fmt.Sprintf("%s (%.2f%%)", r.Name, s*100))
+		}
+	}
+	return
+}
+
+// saveDiffImage renders and saves the diff image from [a] to [b], it returns the file and the number of changed
+// regions
+func saveDiffImage(trigger *models.Trigger, a image.Image, b image.Image) (string, int, error) {
+	diff, regions, err := utils.ImageDiff(a, b, trigger.MaskRectangles())
 	if err != nil {
-		return errors.WithStack(err)
+		return "", 0, err
+	}
+	filename, err := utils.ImageSaveThumb(diff)
+	return filename, len(regions), err
+}
+
+func changedRegionsLog(changedRegions []string) string {
+	if len(changedRegions) == 0 {
+		return ""
+	}
+	return ", regions: " + strings.Join(changedRegions, ", ")
+}
+
+func sizeChangeLog(sizeChange string) string {
+	if sizeChange == "" {
+		return ""
+	}
+	return ", size: " + sizeChange
+}
+
+// getBaseImage returns the latest version of the sentry when the task was created, nil if it is the first check
+func getBaseImage(t *models.Task) (baseImage *models.SentryImage, err error) {
+	if t.BaseImageID == nil {
+		return nil, nil
+	}
+	err = models.Transaction(func(tx models.TX) (err error) {
+		baseImage, err = tx.GetSentryImage(*t.BaseImageID)
+		return
+	})
+	return baseImage, errors.WithStack(err)
+}
+
+// compareSentryTaskImage compares the result with the latest image of the sentry and records it.
+// [similarity] is nil if there wasn't an image to compare with. [changed] is true if a new image is recorded.
+func compareSentryTaskImage(t *models.Task) (similarity *float64, changed bool, err error) {
+	data, err := utils.TaskResultRead(t.ID)
+	if err != nil {
+		return
+	}
+	b, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	trigger := models.Trigger{}
+	err = json.Unmarshal([]byte(t.Trigger), &trigger)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	task, err := models.ParseTaskSpec(t.Task)
+	if err != nil {
+		return
+	}
+
+	baseImage, err := getBaseImage(t)
+	if err != nil {
+		return
 	}
 
 	// first time
-	if ti.baseImage == nil {
+	if baseImage == nil {
 
 		imageFilename, err := utils.ImageSave(b)
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, false, errors.WithStack(err)
 		}
 
 		err = models.Transaction(func(tx models.TX) (err error) {
-			return tx.UpdateSentryAfterCheck(ti.sentryID, true, imageFilename)
+			return tx.UpdateSentryAfterCheck(t.SentryID, true, false, imageFilename, "")
 		})
 
 		if err != nil {
@@ -483,37 +1085,73 @@ func compareSentryTaskImage(tid int32, ti *taskInfo) error {
 
 		if errors.Is(err, models.ErrSentryNotRunning) {
 			log.Println(err)
-			err = nil
+			return nil, false, nil
 		}
-		return errors.WithStack(err)
+		return nil, err == nil, errors.WithStack(err)
 	}
 
-	a, err := imaging.Open(utils.ImageGetFullPath(ti.baseImage.File, false))
+	a, err := imaging.Open(utils.ImageGetFullPath(baseImage.File, false))
 
 	if err != nil {
 		// TODO: error handling
-		return errors.WithStack(err)
+		err = errors.WithStack(err)
+		return
+	}
+
+	change := &sentryChange{
+		beforeTime:  baseImage.CreatedAt,
+		beforeImage: baseImage.File,
 	}
 
-	similarity, err := utils.ImageCompare(a, b)
+	// the new image is saved as it is, only the comparison uses the padded images
+	pa, pb := a, b
+	if sa, sb := a.Bounds().Size(), b.Bounds().Size(); sa != sb {
+		change.sizeChange = fmt.Sprintf("%dx%d → %dx%d", sa.X, sa.Y, sb.X, sb.Y)
+		pa, pb = utils.ImagePad(a, b)
+	}
+
+	var s float64
+	var changedRegions []image.Rectangle
+	if len(task.Regions) > 0 {
+		s, changedRegions, change.changedRegions, err = compareRegions(&trigger, task, pa, pb)
+		changed = len(changedRegions) > 0
+	} else {
+		s, changed, err = compareImages(&trigger, pa, pb)
+	}
 	if err != nil {
-		return err
+		return
 	}
-	changed := float64(similarity) < ti.trigger.SimilarityThreshold
-	newImage := ""
+	if change.sizeChange != "" && trigger.GetSizePolicy() == models.SizePolicyChange {
+		s, changed = 0, true
+	}
+	similarity = &s
+	change.similarity = float32(s)
 	if changed {
 		// changed
 		// save new image
-		newImage, err = utils.ImageSave(b)
+		change.afterImage, err = utils.ImageSave(b)
 		if err != nil {
-			return err
+			return similarity, false, err
+		}
+		// the change is still recorded without the diff
+		var e error
+		da, db := pa, pb
+		if len(changedRegions) > 0 {
+			// only the changed regions are shown
+			da, db = utils.ImageKeepRegions(pa, changedRegions), utils.ImageKeepRegions(pb, changedRegions)
+		}
+		change.diffImage, change.regions, e = saveDiffImage(&trigger, da, db)
+		if e != nil {
+			log.Printf("[compareSentryTaskImage] Error occurred in sentry: %x, diff image: %+v \n", t.SentryID, e)
 		}
 	}
 
-	log.Printf("[compareSentryTaskImage] Info: sentry: %x, similarity: %.2f%%, changed: %v \n", ti.sentryID, similarity*100, changed)
+	log.Printf("[compareSentryTaskImage] Info: sentry: %x, algorithm: %v, similarity: %.2f%%, changed: %v%v%v \n",
+		t.SentryID, trigger.GetAlgorithm(), s*100, changed, sizeChangeLog(change.sizeChange),
+		changedRegionsLog(change.changedRegions))
 
 	err = models.Transaction(func(tx models.TX) (err error) {
-		return tx.UpdateSentryAfterCheck(ti.sentryID, changed, newImage)
+		return tx.UpdateSentryAfterCheck(t.SentryID, changed, changed, change.afterImage, change.diffImage)
 	})
 
 	if changed {
@@ -521,16 +1159,20 @@ func compareSentryTaskImage(tid int32, ti *taskInfo) error {
 			// success
 
 			// notification
-			e := toggleNotification(ti.sentryID, ti.baseImage.CreatedAt, ti.baseImage.File, newImage, similarity)
+			e := toggleNotification(t.SentryID, change)
 			if e != nil {
-				log.Printf("[toggleNotification] Error occurred in sentry: %x, err: %v \n", ti.sentryID, e)
+				log.Printf("[toggleNotification] Error occurred in sentry: %x, err: %v \n", t.SentryID, e)
 			}
 
 			// delete old file (keep thumb)
-			utils.ImageDelete(ti.baseImage.File, true)
+			utils.ImageDelete(baseImage.File, true)
 		} else {
 			// delete new file (delete all)
-			utils.ImageDelete(newImage, false)
+			utils.ImageDelete(change.afterImage, false)
+			if change.diffImage != "" {
+				utils.ImageDelete(change.diffImage, false)
+			}
+			changed = false
 		}
 	}
 
@@ -538,5 +1180,5 @@ func compareSentryTaskImage(tid int32, ti *taskInfo) error {
 		log.Println(err)
 		err = nil
 	}
-	return errors.WithStack(err)
+	return similarity, changed, errors.WithStack(err)
 }
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/websentry/websentry/models"
+	"github.com/websentry/websentry/utils"
+)
+
+// the maximum size of the text submitted by a worker
+const maxTextSize = 1 << 20
+
+// compareSentryTaskText compares the text submitted by the worker with the latest version line by line. A text
+// sentry is changed if any line is added or removed, [similarity] is the share of the lines that are the same.
+// If the trigger has conditions, a changed text is recorded but only notified when the conditions become met, the
+// first text is notified if they are already met.
+func compareSentryTaskText(t *models.Task) (similarity *float64, changed bool, err error) {
+	trigger, err := models.ParseTrigger(t.Trigger)
+	if err != nil {
+		return
+	}
+	data, err := utils.TaskResultRead(t.ID)
+	if err != nil {
+		return
+	}
+	if len(data) > maxTextSize {
+		return nil, false, errors.Errorf("text is larger than %d bytes", maxTextSize)
+	}
+	text := strings.ToValidUTF8(string(data), "�")
+
+	baseText, err := getBaseImage(t)
+	if err != nil {
+		return
+	}
+
+	// first time
+	if baseText == nil {
+		met, conditions, err := evaluateConditions(trigger, text)
+		if err != nil {
+			return nil, false, err
+		}
+		filename, err := utils.TextSave(text)
+		if err != nil {
+			return nil, false, err
+		}
+
+		err = models.Transaction(func(tx models.TX) (err error) {
+			return tx.UpdateSentryAfterCheck(t.SentryID, true, met, filename, "")
+		})
+
+		if err != nil {
+			utils.TextDelete(filename)
+		} else if met {
+			e := toggleNotification(t.SentryID, &sentryChange{beforeTime: time.Now(), similarity: 1,
+				conditions: conditions})
+			if e != nil {
+				log.Printf("[toggleNotification] Error occurred in sentry: %x, err: %v \n", t.SentryID, e)
+			}
+		}
+
+		if errors.Is(err, models.ErrSentryNotRunning) {
+			log.Println(err)
+			return nil, false, nil
+		}
+		return nil, err == nil, errors.WithStack(err)
+	}
+
+	old, err := utils.TextRead(baseText.File)
+	if err != nil {
+		return
+	}
+	oldLines, newLines := utils.TextLines(old), utils.TextLines(text)
+	change := &sentryChange{
+		beforeTime: baseText.CreatedAt,
+	}
+	equal := 0
+	for _, line := range utils.LineDiff(oldLines, newLines) {
+		switch line.Op {
+		case utils.LineEqual:
+			equal++
+		case utils.LineAdded:
+			change.added = append(change.added, line.Text)
+		case utils.LineRemoved:
+			change.removed = append(change.removed, line.Text)
+		}
+	}
+
+	s := 1.0
+	if len(oldLines)+len(newLines) > 0 {
+		s = float64(2*equal) / float64(len(oldLines)+len(newLines))
+	}
+	similarity = &s
+	change.similarity = float32(s)
+	changed = len(change.added) > 0 || len(change.removed) > 0
+	notified := changed
+	if changed && len(trigger.Conditions) > 0 {
+		before, _, err := evaluateConditions(trigger, old)
+		if err != nil {
+			return similarity, false, err
+		}
+		var met bool
+		met, change.conditions, err = evaluateConditions(trigger, text)
+		if err != nil {
+			return similarity, false, err
+		}
+		notified = met && !before
+	}
+	newText := ""
+	if changed {
+		// all the versions are kept, they are small
+		newText, err = utils.TextSave(text)
+		if err != nil {
+			return similarity, false, err
+		}
+	}
+
+	log.Printf("[compareSentryTaskText] Info: sentry: %x, added: %d, removed: %d, changed: %v, notified: %v \n",
+		t.SentryID, len(change.added), len(change.removed), changed, notified)
+
+	err = models.Transaction(func(tx models.TX) (err error) {
+		return tx.UpdateSentryAfterCheck(t.SentryID, changed, notified, newText, "")
+	})
+
+	if changed {
+		if err == nil {
+			if notified {
+				e := toggleNotification(t.SentryID, change)
+				if e != nil {
+					log.Printf("[toggleNotification] Error occurred in sentry: %x, err: %v \n", t.SentryID, e)
+				}
+			}
+		} else {
+			utils.TextDelete(newText)
+			changed = false
+		}
+	}
+
+	if errors.Is(err, models.ErrSentryNotRunning) {
+		log.Println(err)
+		err = nil
+	}
+	return similarity, changed, errors.WithStack(err)
+}
+
+// evaluateConditions returns the combined state of the conditions of the trigger and the ones that are met. A trigger
+// without conditions is never met.
+func evaluateConditions(trigger *models.Trigger, text string) (met bool, conditions []models.ConditionResult,
+	err error) {
+	if len(trigger.Conditions) == 0 {
+		return false, nil, nil
+	}
+	met, results, err := trigger.EvaluateConditions(text)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, r := range results {
+		if r.Met {
+			conditions = append(conditions, r)
+		}
+	}
+	return met, conditions, nil
+}
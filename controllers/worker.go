@@ -1,16 +1,21 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 
+	"github.com/websentry/websentry/config"
 	"github.com/websentry/websentry/models"
 	"github.com/websentry/websentry/utils"
 )
@@ -20,327 +25,814 @@ const (
 	// nginx default is 60s and cloudflare is 100s
 	longPollingTimeout = 42 * time.Second
 
+	// the scheduler stops adding sentry tasks if there are already this many in the queue
 	queueBuffer = 100
+	// the queue is shared by all masters, tasks added by others are only noticed by polling
+	taskPollInterval = 3 * time.Second
+
+	// the worker has to submit the result or extend the lease in time, otherwise the task goes back to the queue
+	taskLease       = 4 * time.Minute
+	maxTaskAttempts = 3
+	// how long the result of a full screenshot task is kept
+	fullScreenshotRetention = 2 * time.Minute
+	// how long the result of a check requested by a user is kept
+	sentryCheckRetention = 2 * time.Minute
+
+	// tasks a user is waiting for
+	taskPriorityHigh = 1
+
+	maxWorkerIDLength      = 64
+	maxWorkerVersionLength = 32
 )
 
-type taskStatus int8
+func taskQueueTimeout(mode models.TaskMode) time.Duration {
+	if mode == models.TMFullScreenshot {
+		return time.Minute
+	}
+	return 5 * time.Minute
+}
 
-const (
-	taskStatusInQueue taskStatus = iota
-	taskStatusAssigned
-	taskStatusCompleted
-)
+// The queue itself lives in the database so that it is shared by all masters and survives restarts.
+// The channels only wake up requests in this master without waiting for the next poll.
+type taskQueue struct {
+	// one message for each task queued by this master
+	notify chan bool
 
-type taskMode int8
+	// closed once the task is done, for requests waiting on it
+	waitMux sync.Mutex
+	wait    map[int64]chan bool
+}
 
-const (
-	taskModeFullScreen taskMode = iota
-	taskModeSentry
-)
+var taskq taskQueue
 
-type taskInfo struct {
-	// common
-	mode         taskMode
-	status       taskStatus
-	image        []byte
-	feedbackCode int
-	feedbackMsg  string
-	task         gin.H
-	expire       time.Time
-
-	// screenshot
-	user     int64
-	channel  chan bool
-	tmpToken string // tmp token for get request for the actual image
-
-	// sentry
-	sentryID  int64
-	baseImage *models.SentryImage
-	trigger   models.Trigger
+func notifyTaskQueued() {
+	select {
+	case taskq.notify <- true:
+	default:
+		// workers will find it by polling
+	}
 }
 
-type taskQueue struct {
+func getTaskWaitChannel(tid int64) chan bool {
+	taskq.waitMux.Lock()
+	defer taskq.waitMux.Unlock()
+
+	ch, ok := taskq.wait[tid]
+	if !ok {
+		ch = make(chan bool)
+		taskq.wait[tid] = ch
+	}
+	return ch
+}
 
-	// high priority queue (screenshot)
-	pQueue chan int32
-	// normal queue (sentry task)
-	nQueue chan int32
+func notifyTaskDone(tid int64) {
+	taskq.waitMux.Lock()
+	defer taskq.waitMux.Unlock()
 
-	infoMux sync.Mutex
-	info    map[int32]*taskInfo
+	if ch, ok := taskq.wait[tid]; ok {
+		close(ch)
+		delete(taskq.wait, tid)
+	}
 }
 
-var taskq taskQueue
+func isTaskDone(t *models.Task) bool {
+	return t.State == models.TSCompleted || t.State == models.TSFailed
+}
 
-func cleanTask() {
-	for {
-		time.Sleep(10 * time.Minute)
-		n := time.Now()
-		taskq.infoMux.Lock()
-		for k, v := range taskq.info {
-			if n.After(v.expire) {
-				delete(taskq.info, k)
+func requeueExpiredTasks() {
+	var requeued []models.Task
+	err := models.Transaction(func(tx models.TX) (err error) {
+		var failed []models.Task
+		requeued, failed, err = tx.RequeueExpiredTasks(maxTaskAttempts, taskQueueTimeout)
+		if err != nil {
+			return
+		}
+		// the workers didn't submit in time
+		for _, t := range append(failed, requeued...) {
+			err = tx.AddWorkerStats(t.WorkerID, 0, 0, 1)
+			if err != nil {
+				return
 			}
 		}
+		return
+	})
+	if err != nil {
+		log.Printf("[requeueExpiredTasks] Error: %+v", err)
+		return
+	}
 
-		taskq.infoMux.Unlock()
+	for i := range requeued {
+		log.Printf("Requeue task after lease expired. tid: %v, attempts: %v \n", requeued[i].ID, requeued[i].Attempts)
+		notifyTaskQueued()
 	}
 }
 
-func insertTaskinfo(ti *taskInfo) int32 {
-	tid := rand.Int31()
+// processUnprocessedSentryTasks picks up results that were not processed, e.g. the master that received it
+// was restarted. Failed tasks whose lease expired also end up here.
+func processUnprocessedSentryTasks() {
+	var unprocessed []models.Task
+	err := models.Transaction(func(tx models.TX) (err error) {
+		unprocessed, err = tx.GetUnprocessedSentryTasks()
+		return
+	})
+	if err != nil {
+		log.Printf("[processUnprocessedSentryTasks] Error: %+v", err)
+		return
+	}
 
-	taskq.infoMux.Lock()
-	var ok bool
+	for i := range unprocessed {
+		queueSentryTask(&unprocessed[i])
+	}
+}
+
+func cleanTask() {
 	for {
-		if _, ok = taskq.info[tid]; !ok {
-			break
+		requeueExpiredTasks()
+		processUnprocessedSentryTasks()
+
+		var ids []int64
+		err := models.Transaction(func(tx models.TX) (err error) {
+			ids, err = tx.DeleteStaleTasks()
+			return
+		})
+		if err != nil {
+			log.Printf("[cleanTask] Error: %+v", err)
 		}
-		tid = rand.Int31()
+		for _, id := range ids {
+			utils.TaskResultDelete(id)
+			notifyTaskDone(id)
+		}
+
+		err = models.Transaction(func(tx models.TX) error {
+			// older ones are rejected by their timestamp
+			return tx.DeleteWorkerSignatures(time.Now().Add(-2 * models.WorkerSignatureMaxAge))
+		})
+		if err != nil {
+			log.Printf("[cleanTask] Error: %+v", err)
+		}
+
+		err = models.Transaction(func(tx models.TX) error {
+			return tx.DeleteRateLimits(time.Now().Add(-models.MaxRateLimitPeriod))
+		})
+		if err != nil {
+			log.Printf("[cleanTask] Error: %+v", err)
+		}
+
+		time.Sleep(time.Minute)
 	}
+}
 
-	taskq.info[tid] = ti
-	taskq.infoMux.Unlock()
+func newSentryTask(s *models.Sentry, i *models.SentryImage) (*models.Task, error) {
+	// make sure they are valid before handing them to workers
+	task, err := models.ParseTaskSpec(s.Task)
+	if err != nil {
+		return nil, err
+	}
+	_, err = models.ParseTrigger(s.Trigger)
+	if err != nil {
+		return nil, err
+	}
 
-	return tid
+	t := &models.Task{
+		Mode:             models.TMSentry,
+		Task:             s.Task,
+		SentryID:         s.ID,
+		Trigger:          s.Trigger,
+		Host:             task.Host(),
+		RequiredTags:     s.RequiredTags,
+		RequiredFeatures: task.RequiredFeatures(),
+	}
+	if i != nil {
+		t.BaseImageID = &i.ID
+	}
+	return t, nil
 }
 
-func addSentryTask(s *models.Sentry, i *models.SentryImage) (int32, error) {
-	task := gin.H{}
-	err := json.Unmarshal([]byte(s.Task), &task)
+func addSentryTask(s *models.Sentry, i *models.SentryImage) (int64, error) {
+	t, err := newSentryTask(s, i)
 	if err != nil {
 		return 0, err
 	}
-	trigger := models.Trigger{}
-	err = json.Unmarshal([]byte(s.Trigger), &trigger)
+
+	spacing := time.Duration(config.GetConfig().Scheduler.HostSpacing) * time.Second
+	err = models.Transaction(func(tx models.TX) error {
+		// checks of the same host are spread out by [spacing]
+		t.AvailableAt = time.Now()
+		if t.Host != "" && spacing > 0 {
+			last, err := tx.LastHostTaskTime(t.Host)
+			if err != nil {
+				return err
+			}
+			if last.Add(spacing).After(t.AvailableAt) {
+				t.AvailableAt = last.Add(spacing)
+			}
+		}
+		t.ExpireAt = t.AvailableAt.Add(taskQueueTimeout(models.TMSentry))
+		return tx.CreateTask(t)
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	ti := new(taskInfo)
-	ti.task = task
-	ti.mode = taskModeSentry
-	ti.status = taskStatusInQueue
-	ti.sentryID = s.ID
-	ti.baseImage = i
-	ti.trigger = trigger
-	ti.expire = time.Now().Add(time.Minute * 5)
+	notifyTaskQueued()
+	return t.ID, nil
+}
+
+// requestSentryCheck queues a check of the sentry on behalf of the user, ahead of scheduled ones.
+// If a check is already queued or running, that one is used instead.
+func requestSentryCheck(s *models.Sentry, i *models.SentryImage, user int64) (int64, error) {
+	t, err := newSentryTask(s, i)
+	if err != nil {
+		return 0, err
+	}
+	t.Priority = taskPriorityHigh
+	t.UserID = user
+	// the host spacing doesn't apply, the user is waiting for it
+	t.ExpireAt = time.Now().Add(taskQueueTimeout(models.TMSentry))
 
-	tid := insertTaskinfo(ti)
+	err = models.Transaction(func(tx models.TX) error {
+		active, err := tx.GetActiveSentryTask(s.ID)
+		if err != nil {
+			return err
+		}
+		if active != nil {
+			t = active
+			return tx.PrioritizeTask(t.ID, taskPriorityHigh, user)
+		}
+		return tx.CreateTask(t)
+	})
+	if err != nil {
+		return 0, err
+	}
 
-	taskq.nQueue <- tid
-	return tid, nil
+	notifyTaskQueued()
+	return t.ID, nil
 }
 
-func addFullScreenshotTask(task gin.H, user int64) int32 {
-	ti := new(taskInfo)
-	ti.task = task
-	ti.mode = taskModeFullScreen
-	ti.status = taskStatusInQueue
-	ti.expire = time.Now().Add(time.Minute * 1)
-	ti.channel = make(chan bool)
-	ti.user = user
+func addFullScreenshotTask(task *models.TaskSpec, user int64) (int64, error) {
+	taskJSON, err := task.JSON()
+	if err != nil {
+		return 0, err
+	}
+
+	t := &models.Task{
+		Mode:             models.TMFullScreenshot,
+		Priority:         taskPriorityHigh,
+		Task:             taskJSON,
+		RequiredFeatures: task.RequiredFeatures(),
+		ExpireAt:         time.Now().Add(taskQueueTimeout(models.TMFullScreenshot)),
+		UserID:           user,
+	}
 
-	tid := insertTaskinfo(ti)
+	err = models.Transaction(func(tx models.TX) error {
+		return tx.CreateTask(t)
+	})
+	if err != nil {
+		return 0, err
+	}
 
-	taskq.pQueue <- tid
-	return tid
+	notifyTaskQueued()
+	return t.ID, nil
 }
 
-func getTask() (int32, *taskInfo) {
-	var tid int32
+// getTask waits for a task that the worker can run. It returns nil once [ctx] is done.
+func getTask(ctx context.Context, workerID string, filter models.TaskFilter) *models.Task {
+	filter.HostConcurrency = config.GetConfig().Scheduler.HostConcurrency
 
 	for {
-		// select from priority queue first
-		select {
-		case tid = <-taskq.pQueue:
-			goto assign
-		default:
+		var t *models.Task
+		err := models.Transaction(func(tx models.TX) (err error) {
+			t, err = tx.ClaimNextTask(workerID, taskLease, filter)
+			if err != nil || t == nil {
+				return
+			}
+			return tx.AddWorkerStats(workerID, 1, 0, 0)
+		})
+		if err != nil {
+			log.Printf("[getTask] Error: %+v", err)
+		}
+		if t != nil {
+			return t
 		}
 
-		// select from the one that has task
 		select {
-		case tid = <-taskq.pQueue:
-			goto assign
-		case tid = <-taskq.nQueue:
-			goto assign
-		case <-time.After(longPollingTimeout):
-			return -1, nil
+		case <-taskq.notify:
+		case <-time.After(taskPollInterval):
+		case <-ctx.Done():
+			return nil
 		}
+	}
+}
 
-	assign:
-		taskq.infoMux.Lock()
-		// check existence
-		ti, ok := taskq.info[tid]
-		if !ok {
-			taskq.infoMux.Unlock()
-			continue
+// workerTaskFilter records the heartbeat of the worker and returns the tasks it accepts and its protocol
+func workerTaskFilter(c *gin.Context, workerID string) (filter models.TaskFilter, protocol int, err error) {
+	var w *models.Worker
+	err = models.Transaction(func(tx models.TX) (err error) {
+		err = tx.WorkerHeartbeat(workerID, c.ClientIP())
+		if err != nil {
+			return
 		}
-		// check expiration
-		if time.Now().After(ti.expire) {
-			delete(taskq.info, tid)
-			taskq.infoMux.Unlock()
-			continue
+		w, err = tx.GetWorker(workerID)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if w.Tags != "" {
+		err = errors.WithStack(json.Unmarshal([]byte(w.Tags), &filter.Tags))
+		if err != nil {
+			return
 		}
-		taskq.infoMux.Unlock()
+	}
+	filter.Features = w.FeatureSet()
+	protocol = w.Protocol
+	// the ID is sent as a number, larger ones can't be read back exactly
+	if protocol < models.ProtocolV2 {
+		filter.MaxID = models.MaxSafeTaskID
+	}
+
+	// nil for workers using the shared key, they can run all tasks
+	if m, ok := c.Get("workerModes"); ok {
+		filter.Modes = m.([]models.TaskMode)
+	}
+	return
+}
+
+// taskSpec is the task sent to the worker
+func taskSpec(t *models.Task) (*models.TaskSpec, error) {
+	task, err := models.ParseTaskSpec(t.Task)
+	if err != nil {
+		return nil, err
+	}
 
-		ti.expire = time.Now().Add(time.Minute * 4)
-		ti.status = taskStatusAssigned
+	// logging
+	if t.Mode == models.TMFullScreenshot {
+		log.Printf("Assign full screen task to worker. tid: %v, url: %v \n",
+			t.ID, task.URL)
+	} else {
+		log.Printf("Assign sentry task to worker. tid: %v, sentryID: %v, url: %v \n",
+			t.ID, t.SentryID, task.URL)
+	}
+	return task, nil
+}
 
-		return tid, ti
+// extendTaskLease is the heartbeat of a worker running a task, see [WorkerTaskHeartbeat]
+func extendTaskLease(workerID string, ip string, tid int64) (cancelled bool, err error) {
+	err = models.Transaction(func(tx models.TX) (err error) {
+		err = tx.WorkerHeartbeat(workerID, ip)
+		if err != nil {
+			return
+		}
+		cancelled, err = tx.ExtendTaskLease(tid, workerID, taskLease)
+		return
+	})
+	if err == nil && cancelled {
+		log.Printf("Tell worker to stop cancelled task. tid: %v, worker: %v \n", tid, workerID)
 	}
+	return
 }
 
+// workerTaskID is the ID of the task sent to the worker, a number for [models.ProtocolV1] workers (-1 if there
+// isn't a task) and a hex string since [models.ProtocolV2] (null if there isn't a task).
+func workerTaskID(protocol int, t *models.Task) interface{} {
+	if protocol < models.ProtocolV2 {
+		if t == nil {
+			return -1
+		}
+		return t.ID
+	}
+	if t == nil {
+		return nil
+	}
+	return strconv.FormatInt(t.ID, 16)
+}
+
+// parseWorkerTaskID parses [taskId] sent back by the worker in the form of [workerTaskID]. If it returns false, the
+// response has been written already.
+func parseWorkerTaskID(c *gin.Context) (int64, bool) {
+	// workers that haven't called [WorkerInit] speak [models.ProtocolV1]
+	protocol := models.ProtocolV1
+	var w *models.Worker
+	err := models.Transaction(func(tx models.TX) (err error) {
+		w, err = tx.GetWorker(getWorkerID(c))
+		return
+	})
+	if err == nil {
+		protocol = w.Protocol
+	} else if !models.IsErrNoDocument(err) {
+		InternalErrorResponse(c, err)
+		return 0, false
+	}
+
+	base := 16
+	if protocol < models.ProtocolV2 {
+		base = 10
+	}
+	tid, err := strconv.ParseInt(c.Query("taskId"), base, 64)
+	if err != nil {
+		JSONResponse(c, CodeWrongParam, "", nil)
+		return 0, false
+	}
+	return tid, true
+}
+
+// getWorkerID returns the name of the credential, or [SharedKeyWorkerID] if the worker uses the shared key
+func getWorkerID(c *gin.Context) string {
+	if id := c.GetString("workerId"); id != "" {
+		return id
+	}
+	return SharedKeyWorkerID(c)
+}
+
+// SharedKeyWorkerID returns the ID the worker registered with, after [models.SharedKeyWorkerPrefix]. Older workers
+// don't have one, their IP is used instead.
+func SharedKeyWorkerID(c *gin.Context) string {
+	id := c.GetHeader("WS-Worker-ID")
+	if id == "" {
+		id = c.ClientIP()
+	}
+	return models.SharedKeyWorkerPrefix + id
+}
+
+// WorkerInit registers the worker and negotiates the protocol. It returns the protocol version, the schema of
+// tasks and the features the master knows of the worker. Only tasks requiring these features are assigned.
+// [version] version of the worker
+// [protocol] the highest protocol version the worker speaks, workers without it speak [models.ProtocolV1]
+// [capabilities] comma separated, the ones that are features are used since [models.ProtocolV2]
+// [tags] comma separated, e.g. "region=eu,mobile", only tasks requiring a subset of them are assigned
 func WorkerInit(c *gin.Context) {
-	JSONResponse(c, CodeOK, "", nil)
+	id := getWorkerID(c)
+	if len(id) > maxWorkerIDLength {
+		JSONResponse(c, CodeWrongParam, "Invalid worker id", nil)
+		return
+	}
+
+	protocol := models.ProtocolV1
+	if s, ok := c.GetQuery("protocol"); ok {
+		var err error
+		protocol, err = strconv.Atoi(s)
+		if err != nil || protocol < models.ProtocolV1 {
+			JSONResponse(c, CodeWrongParam, "Invalid protocol", nil)
+			return
+		}
+		if protocol > models.CurrentProtocol {
+			protocol = models.CurrentProtocol
+		}
+	}
+
+	capabilities := []string{}
+	for _, s := range strings.Split(c.Query("capabilities"), ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			capabilities = append(capabilities, s)
+		}
+	}
+	capabilitiesJSON, err := json.Marshal(&capabilities)
+	if err != nil {
+		InternalErrorResponse(c, errors.WithStack(err))
+		return
+	}
+
+	tags, err := models.ParseTags(c.Query("tags"))
+	if err != nil || len(tags) > models.MaxWorkerTags {
+		JSONResponse(c, CodeWrongParam, "Invalid tags", nil)
+		return
+	}
+	tagsJSON, err := json.Marshal(&tags)
+	if err != nil {
+		InternalErrorResponse(c, errors.WithStack(err))
+		return
+	}
+
+	w := &models.Worker{
+		ID:           id,
+		Version:      c.Query("version"),
+		Capabilities: string(capabilitiesJSON),
+		Tags:         string(tagsJSON),
+		Protocol:     protocol,
+		Features:     models.FeatureMask(capabilities),
+		IP:           c.ClientIP(),
+	}
+	if len(w.Version) > maxWorkerVersionLength {
+		JSONResponse(c, CodeWrongParam, "Invalid version", nil)
+		return
+	}
+	err = models.Transaction(func(tx models.TX) error {
+		return tx.RegisterWorker(w)
+	})
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return
+	}
+
+	features := models.FeatureNames(w.FeatureSet())
+	log.Printf("Worker registered. id: %v, version: %v, protocol: %v, features: %v, tags: %v \n",
+		w.ID, w.Version, w.Protocol, features, tags)
+	JSONResponse(c, CodeOK, "", gin.H{
+		"protocol":   w.Protocol,
+		"taskSchema": models.TaskSchema,
+		"features":   features,
+	})
 }
 
 func WorkerFetchTask(c *gin.Context) {
-	tid, ti := getTask()
+	workerID := getWorkerID(c)
+	if len(workerID) > maxWorkerIDLength {
+		JSONResponse(c, CodeWrongParam, "Invalid worker id", nil)
+		return
+	}
 
-	if tid >= 0 {
-		// logging
-		if ti.mode == taskModeFullScreen {
-			log.Printf("Assign full screen task to worker. tid: %v, url: %v \n",
-				tid, ti.task["url"].(string))
-		} else {
-			log.Printf("Assign sentry task to worker. tid: %v, sentryID: %v, url: %v \n",
-				tid, ti.sentryID, ti.task["url"].(string))
+	// fetching tasks is the heartbeat of the worker
+	filter, protocol, err := workerTaskFilter(c, workerID)
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), longPollingTimeout)
+	defer cancel()
+	t := getTask(ctx, workerID, filter)
+
+	if t != nil {
+		// the lease will expire and the task will be requeued
+		task, err := taskSpec(t)
+		if err != nil {
+			InternalErrorResponse(c, err)
+			return
 		}
 
 		JSONResponse(c, CodeOK, "", gin.H{
-			"taskId": tid,
-			"task":   ti.task,
+			"taskId": workerTaskID(protocol, t),
+			"task":   task,
 		})
 	} else {
 		JSONResponse(c, CodeOK, "", gin.H{
-			"taskId": -1,
+			"taskId": workerTaskID(protocol, nil),
 		})
 	}
 }
 
-func WorkerSubmitTask(c *gin.Context) {
-	taskq.infoMux.Lock()
-	defer taskq.infoMux.Unlock()
+// WorkerTaskHeartbeat extends the lease of a running task by [taskLease]. If the task has been cancelled,
+// "cancelled" is true and the worker should stop working on it.
+// [taskId]
+func WorkerTaskHeartbeat(c *gin.Context) {
+	tid, ok := parseWorkerTaskID(c)
+	if !ok {
+		return
+	}
 
-	tid, err := strconv.ParseInt(c.Query("taskId"), 10, 32)
+	cancelled, err := extendTaskLease(getWorkerID(c), c.ClientIP(), tid)
 	if err != nil {
-		JSONResponse(c, CodeWrongParam, "", nil)
+		if errors.Is(err, models.ErrTaskNotAssignable) {
+			// the lease has expired or the task is assigned to someone else
+			JSONResponse(c, CodeNotExist, "", nil)
+		} else {
+			InternalErrorResponse(c, err)
+		}
 		return
 	}
 
-	ti, ok := taskq.info[int32(tid)]
+	JSONResponse(c, CodeOK, "", gin.H{
+		"cancelled": cancelled,
+	})
+}
+
+func WorkerSubmitTask(c *gin.Context) {
+	tid, ok := parseWorkerTaskID(c)
 	if !ok {
-		JSONResponse(c, CodeNotExist, "", nil)
 		return
 	}
 
-	feedbackCode, err := strconv.ParseInt(c.Query("feedback"), 10, 32)
+	feedbackCode, _ := strconv.ParseInt(c.Query("feedback"), 10, 32)
+	feedbackMsg := ""
+	var image []byte
 	if feedbackCode != 0 {
-		ti.feedbackCode = int(feedbackCode)
-		ti.feedbackMsg = c.Query("msg")
+		feedbackMsg = c.Query("msg")
 	} else {
-		ti.feedbackCode = 0
-
+		// text tasks submit "text" instead of "image"
+		isText := false
 		fileH, err := c.FormFile("image")
+		if err == http.ErrMissingFile {
+			fileH, err = c.FormFile("text")
+			isText = true
+		}
 		if err != nil {
 			JSONResponse(c, CodeWrongParam, "Image error", nil)
 			return
 		}
 
-		file, _ := fileH.Open()
-		ti.image, _ = ioutil.ReadAll(file)
+		file, err := fileH.Open()
+		if err != nil {
+			InternalErrorResponse(c, errors.WithStack(err))
+			return
+		}
+		var r io.Reader = file
+		if isText {
+			// one more byte to tell if it is too large
+			r = io.LimitReader(file, maxTextSize+1)
+		}
+		image, err = ioutil.ReadAll(r)
+		file.Close()
+		if err != nil {
+			InternalErrorResponse(c, errors.WithStack(err))
+			return
+		}
+		if isText && len(image) > maxTextSize {
+			JSONResponse(c, CodeWrongParam, "Text is too large", nil)
+			return
+		}
+	}
 
+	var t *models.Task
+	saved := false
+	err := models.Transaction(func(tx models.TX) (err error) {
+		t, err = tx.GetTask(tid)
+		if err != nil {
+			return
+		}
+		// a worker can only submit once for the task it is running, duplicate and late results are rejected
+		if t.Mode == models.TMFullScreenshot {
+			if feedbackCode == 0 {
+				t.ImageToken = utils.RandStringBytes(16)
+			}
+			err = tx.FinishTask(t.ID, getWorkerID(c), int(feedbackCode), feedbackMsg, t.ImageToken, fullScreenshotRetention)
+		} else {
+			// it can be picked up by [processUnprocessedSentryTasks] right away if this master fails to process it
+			err = tx.FinishTask(t.ID, getWorkerID(c), int(feedbackCode), feedbackMsg, "", 0)
+		}
+		if err != nil {
+			return
+		}
+		if feedbackCode != 0 {
+			return tx.AddWorkerStats(t.WorkerID, 0, 0, 1)
+		}
+		// the result is saved before the task is seen as completed by other masters, the task stays assigned
+		// (and can be submitted again) if it fails
+		err = utils.TaskResultSave(t.ID, image)
+		if err != nil {
+			return
+		}
+		saved = true
+		return tx.AddWorkerStats(t.WorkerID, 0, 1, 0)
+	})
+	if err != nil {
+		if saved {
+			utils.TaskResultDelete(tid)
+		}
+		if models.IsErrNoDocument(err) {
+			JSONResponse(c, CodeNotExist, "", nil)
+		} else if errors.Is(err, models.ErrTaskNotAssignable) {
+			log.Printf("Reject result of task. tid: %v, worker: %v, state: %v \n", tid, getWorkerID(c), t.State)
+			JSONResponse(c, CodeTaskNotAssignable, "", nil)
+		} else {
+			InternalErrorResponse(c, err)
+		}
+		return
 	}
 
-	ti.status = taskStatusCompleted
-	ti.expire = time.Now().Add(time.Minute * 2)
+	t.FeedbackCode = int(feedbackCode)
+	t.FeedbackMsg = feedbackMsg
+	if feedbackCode != 0 {
+		t.State = models.TSFailed
+	} else {
+		t.State = models.TSCompleted
+	}
 
-	if ti.mode == taskModeFullScreen {
-		ti.tmpToken = utils.RandStringBytes(16)
-		close(ti.channel)
+	if t.Mode == models.TMFullScreenshot {
+		notifyTaskDone(t.ID)
 	} else {
-		// taskModeSentry
-		go func() {
-			// TODO: handle the case where feedbackCode != 0
-			err = compareSentryTaskImage(int32(tid), ti)
-			if err != nil {
-				log.Printf("[compareSentryTaskImage] Error occurred in task: %d, err: %v", tid, err)
-			}
-		}()
+		queueSentryTask(t)
 	}
 
 	JSONResponse(c, CodeOK, "", nil)
 }
 
-func waitFullScreenshot(c *gin.Context) {
+// userTaskID is the ID of a task requested by the user. It is the decimal number the frontend has always sent back,
+// but as a string: task IDs are too large for JavaScript numbers.
+func userTaskID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
 
-	tid, err := strconv.ParseInt(c.Query("taskId"), 10, 32)
+// waitTask waits until the task of [mode] requested by the user is done. If it returns nil, the response has been
+// written already.
+func waitTask(c *gin.Context, mode models.TaskMode, isDone func(t *models.Task) bool) *models.Task {
+	tid, err := strconv.ParseInt(c.Query("taskId"), 10, 64)
 	if err != nil {
 		JSONResponse(c, CodeWrongParam, "", nil)
-		return
+		return nil
 	}
 
-	taskq.infoMux.Lock()
+	getUserTask := func() (t *models.Task, err error) {
+		err = models.Transaction(func(tx models.TX) (err error) {
+			t, err = tx.GetTask(tid)
+			return
+		})
+		if models.IsErrNoDocument(err) {
+			return nil, nil
+		}
+		if t != nil && (t.Mode != mode || t.UserID != c.MustGet("userId")) {
+			return nil, nil
+		}
+		return
+	}
 
-	ti, ok := taskq.info[int32(tid)]
-	if !ok || ti.mode != taskModeFullScreen || ti.user != c.MustGet("userId") {
-		taskq.infoMux.Unlock()
+	t, err := getUserTask()
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return nil
+	}
+	if t == nil {
 		JSONResponse(c, CodeNotExist, "", nil)
-		return
+		return nil
 	}
-	incomplete := ti.status != taskStatusCompleted
-	taskq.infoMux.Unlock()
 
-	timeoutFlag := false
-	if incomplete {
+	timeout := time.After(longPollingTimeout)
+	for !isDone(t) {
+		// the result may be submitted to another master, so poll the database as well
+		ch := getTaskWaitChannel(t.ID)
 		select {
-		case <-ti.channel:
-			timeoutFlag = false
-		case <-time.After(longPollingTimeout):
-			timeoutFlag = true
+		case <-ch:
+		case <-time.After(taskPollInterval):
+		case <-timeout:
+			JSONResponse(c, CodeOK, "", gin.H{
+				"complete": false,
+			})
+			return nil
+		}
+
+		t, err = getUserTask()
+		if err != nil {
+			InternalErrorResponse(c, err)
+			return nil
+		}
+		if t == nil {
+			JSONResponse(c, CodeNotExist, "", nil)
+			return nil
 		}
 	}
+	return t
+}
 
-	if timeoutFlag {
-		JSONResponse(c, CodeOK, "", gin.H{
-			"complete": false,
-		})
-	} else {
-		taskq.infoMux.Lock()
-		JSONResponse(c, CodeOK, "", gin.H{
-			"complete":     true,
-			"imageToken":   ti.tmpToken,
-			"feedbackCode": ti.feedbackCode,
-			"feedbackMsg":  ti.feedbackMsg,
-		})
-		taskq.infoMux.Unlock()
+func waitFullScreenshot(c *gin.Context) {
+	t := waitTask(c, models.TMFullScreenshot, isTaskDone)
+	if t == nil {
+		return
+	}
 
+	JSONResponse(c, CodeOK, "", gin.H{
+		"complete":     true,
+		"imageToken":   t.ImageToken,
+		"feedbackCode": t.FeedbackCode,
+		"feedbackMsg":  t.FeedbackMsg,
+	})
+}
+
+func waitSentryCheck(c *gin.Context) {
+	t := waitTask(c, models.TMSentry, func(t *models.Task) bool {
+		return t.State == models.TSProcessed || t.State == models.TSCancelled
+	})
+	if t == nil {
+		return
 	}
+
+	JSONResponse(c, CodeOK, "", gin.H{
+		"complete":     true,
+		"cancelled":    t.State == models.TSCancelled,
+		"similarity":   t.Similarity,
+		"changed":      t.Changed,
+		"feedbackCode": t.FeedbackCode,
+		"feedbackMsg":  t.FeedbackMsg,
+	})
 }
 
 func GetFullScreenshotImage(c *gin.Context) {
-	tid, err := strconv.ParseInt(c.Query("taskId"), 10, 32)
+	tid, err := strconv.ParseInt(c.Query("taskId"), 10, 64)
 	if err != nil {
 		c.String(400, "")
 		return
 	}
 
-	taskq.infoMux.Lock()
-
-	ti, ok := taskq.info[int32(tid)]
+	var t *models.Task
+	err = models.Transaction(func(tx models.TX) (err error) {
+		t, err = tx.GetTask(tid)
+		return
+	})
 	// use imageToken as auth, not WS-User-Token
-	if !ok || ti.tmpToken != c.Query("imageToken") {
-		taskq.infoMux.Unlock()
+	if err != nil || t.ImageToken == "" || t.ImageToken != c.Query("imageToken") {
 		c.String(404, "")
 		return
 	}
-	taskq.infoMux.Unlock()
 
-	if ti.status != taskStatusCompleted || ti.image == nil || ti.mode != taskModeFullScreen {
+	if t.State != models.TSCompleted || t.Mode != models.TMFullScreenshot {
+		c.String(404, "")
+		return
+	}
+
+	image, err := utils.TaskResultRead(t.ID)
+	if err != nil {
 		c.String(404, "")
 		return
 	}
 
-	c.Data(200, "image/jpeg", ti.image)
+	c.Data(200, "image/jpeg", image)
 }
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/websentry/websentry/models"
+)
+
+const (
+	// the worker has to answer pings within [socketReadTimeout]
+	socketPingInterval = 30 * time.Second
+	socketReadTimeout  = 2 * socketPingInterval
+	socketWriteTimeout = 10 * time.Second
+
+	// the most tasks a worker can run at the same time over one connection
+	maxSocketSlots = 8
+)
+
+var workerUpgrader = websocket.Upgrader{
+	// workers are not browsers, they are authenticated by [middlewares.WorkerAuth] instead
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// workerMessage is a message of the worker socket in both directions.
+//
+// The worker sends:
+//
+//	{"type": "ready"}                    it can run one more task, the master pushes one when there is
+//	{"type": "heartbeat", "taskId": id}  same as [WorkerTaskHeartbeat]
+//
+// The master sends:
+//
+//	{"type": "task", "taskId": id, "task": {...}}
+//	{"type": "heartbeat", "taskId": id, "cancelled": false}
+//	{"type": "error", "taskId": id, "code": code}
+//
+// Task IDs are hex strings as for [models.ProtocolV2] workers. Results are still submitted with [WorkerSubmitTask].
+type workerMessage struct {
+	Type      string           `json:"type"`
+	TaskID    string           `json:"taskId,omitempty"`
+	Task      *models.TaskSpec `json:"task,omitempty"`
+	Cancelled *bool            `json:"cancelled,omitempty"`
+	Code      int              `json:"code,omitempty"`
+}
+
+// WorkerSocket is an alternative to polling [WorkerFetchTask]. Tasks are pushed to the worker as soon as it is
+// ready, with the same queue and lease as the HTTP API.
+func WorkerSocket(c *gin.Context) {
+	workerID := getWorkerID(c)
+	if len(workerID) > maxWorkerIDLength {
+		JSONResponse(c, CodeWrongParam, "Invalid worker id", nil)
+		return
+	}
+	filter, protocol, err := workerTaskFilter(c, workerID)
+	if err != nil {
+		InternalErrorResponse(c, err)
+		return
+	}
+	// task IDs are sent in the form of [models.ProtocolV2]
+	if protocol < models.ProtocolV2 {
+		JSONResponse(c, CodeWrongParam, "Invalid protocol", nil)
+		return
+	}
+
+	conn, err := workerUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the response has been written by the upgrader
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a connection supports one writer at a time
+	var writeMux sync.Mutex
+	write := func(msg *workerMessage) error {
+		writeMux.Lock()
+		defer writeMux.Unlock()
+
+		_ = conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		return conn.WriteJSON(msg)
+	}
+
+	ip := c.ClientIP()
+	_ = conn.SetReadDeadline(time.Now().Add(socketReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		// an idle worker is still alive
+		err := workerHeartbeat(workerID, ip)
+		if err != nil {
+			log.Printf("[WorkerSocket] Error: %+v", err)
+		}
+		return conn.SetReadDeadline(time.Now().Add(socketReadTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(socketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout))
+				if err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// one message for each task the worker is ready to run, a slot is taken until the task is sent
+	ready := make(chan bool, maxSocketSlots)
+	slots := make(chan bool, maxSocketSlots)
+	go func() {
+		for {
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return
+			}
+
+			t := getTask(ctx, workerID, filter)
+			if t == nil {
+				return
+			}
+			task, err := taskSpec(t)
+			if err == nil {
+				err = write(&workerMessage{Type: "task", TaskID: strconv.FormatInt(t.ID, 16), Task: task})
+			}
+			if err != nil {
+				// the lease will expire and the task will be requeued
+				log.Printf("[WorkerSocket] Error occurred in sending task %v: %+v", t.ID, err)
+				_ = conn.Close()
+				return
+			}
+			<-slots
+		}
+	}()
+
+	for {
+		var msg workerMessage
+		err = conn.ReadJSON(&msg)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Worker socket closed. worker: %v, error: %v \n", workerID, err)
+			}
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(socketReadTimeout))
+
+		switch msg.Type {
+		case "ready":
+			select {
+			case slots <- true:
+				ready <- true
+			default:
+				err = write(&workerMessage{Type: "error", Code: CodeExceededLimits})
+			}
+		case "heartbeat":
+			tid, parseErr := strconv.ParseInt(msg.TaskID, 16, 64)
+			if parseErr != nil {
+				err = write(&workerMessage{Type: "error", TaskID: msg.TaskID, Code: CodeWrongParam})
+				break
+			}
+			var cancelled bool
+			cancelled, err = extendTaskLease(workerID, ip, tid)
+			if err == nil {
+				err = write(&workerMessage{Type: "heartbeat", TaskID: msg.TaskID, Cancelled: &cancelled})
+			} else if errors.Is(err, models.ErrTaskNotAssignable) {
+				err = write(&workerMessage{Type: "error", TaskID: msg.TaskID, Code: CodeNotExist})
+			}
+		default:
+			err = write(&workerMessage{Type: "error", Code: CodeWrongParam})
+		}
+		if err != nil {
+			log.Printf("[WorkerSocket] Error: %+v", err)
+			return
+		}
+	}
+}
+
+func workerHeartbeat(workerID string, ip string) error {
+	return models.Transaction(func(tx models.TX) error {
+		return tx.WorkerHeartbeat(workerID, ip)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/websentry/websentry/fakeworker"
+)
+
+var fakeWorkerCommand = &cli.Command{
+	Name:  "fake-worker",
+	Usage: "run a worker that renders scripted images instead of taking screenshots, for testing",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "master",
+			Value: "http://127.0.0.1:8080/",
+			Usage: "url of the master",
+		},
+		&cli.StringFlag{
+			Name:  "id",
+			Usage: "ID of the worker, \"fake-\" and the host name by default",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "the shared worker key",
+		},
+		&cli.StringFlag{
+			Name:  "key-id",
+			Usage: "key id of the worker credential, used instead of --key",
+		},
+		&cli.StringFlag{
+			Name:  "secret",
+			Usage: "secret of the worker credential",
+		},
+		&cli.StringFlag{
+			Name:  "script",
+			Usage: "load the behavior of pages from json `FILE`, all pages are unchanged without it",
+		},
+	},
+	Action: fakeWorker,
+}
+
+func fakeWorker(c *cli.Context) error {
+	w := &fakeworker.Worker{
+		Master: c.String("master"),
+		ID:     c.String("id"),
+		Key:    c.String("key"),
+		KeyID:  c.String("key-id"),
+		Secret: c.String("secret"),
+	}
+	if w.ID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		w.ID = "fake-" + hostname
+	}
+	if file := c.String("script"); file != "" {
+		script, err := fakeworker.LoadScript(file)
+		if err != nil {
+			return err
+		}
+		w.Script = script
+	}
+
+	err := w.Init()
+	if err != nil {
+		return err
+	}
+	log.Printf("Fake worker %v is running, master: %v \n", w.ID, w.Master)
+	w.Run(context.Background(), func(err error) {
+		log.Printf("[fakeWorker] Error: %+v", err)
+	})
+	return nil
+}
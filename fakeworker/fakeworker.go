@@ -0,0 +1,396 @@
+// Package fakeworker is a worker that renders images (or text) from a script instead of taking screenshots, so that
+// the master can be tested without a browser or real websites.
+package fakeworker
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/websentry/websentry/models"
+)
+
+// behaviors of a page in the script
+const (
+	// the same image every time
+	Unchanged = "unchanged"
+	// the same image for the first [Rule.After] checks, a different one afterwards (only in [Rule.Area] if it is set)
+	ChangedAfter = "changedAfter"
+	// the same image for the first [Rule.After] checks, afterwards it is cut to half of the height, like a page
+	// that became shorter than the clip
+	ResizedAfter = "resizedAfter"
+	// the check fails with [Rule.FeedbackCode]
+	Fail = "fail"
+)
+
+// the height of a full page screenshot
+const fullPageHeight = 600
+
+// Rule is the script of one page
+type Rule struct {
+	Behavior     string `json:"behavior"`
+	After        int    `json:"after"`
+	FeedbackCode int    `json:"feedbackCode"`
+	FeedbackMsg  string `json:"feedbackMsg"`
+	// the part of the page (not of the clip) changed by [ChangedAfter], the whole page if it is nil
+	Area *models.Rect `json:"area"`
+}
+
+// Script maps URLs to rules, pages that aren't in it are unchanged.
+type Script map[string]Rule
+
+// LoadScript reads a script from a json file, e.g.
+//
+//	{
+//		"https://example.com/": {"behavior": "unchanged"},
+//		"https://example.com/news": {"behavior": "changedAfter", "after": 2},
+//		"https://example.com/price": {"behavior": "changedAfter", "after": 1,
+//			"area": {"x": 100, "y": 0, "width": 40, "height": 30}},
+//		"https://example.com/short": {"behavior": "resizedAfter", "after": 1},
+//		"https://example.com/down": {"behavior": "fail", "feedbackCode": 2, "feedbackMsg": "timeout"}
+//	}
+func LoadScript(file string) (Script, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var script Script
+	err = json.Unmarshal(data, &script)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for u, rule := range script {
+		switch rule.Behavior {
+		case Unchanged, ChangedAfter, ResizedAfter:
+		case Fail:
+			if rule.FeedbackCode == 0 {
+				return nil, errors.Errorf("feedbackCode of %v must not be 0", u)
+			}
+		default:
+			return nil, errors.Errorf("unknown behavior of %v: %q", u, rule.Behavior)
+		}
+	}
+	return script, nil
+}
+
+// Worker speaks the same protocol as the real worker. It authenticates with [Worker.KeyID] and [Worker.Secret]
+// if they are set, otherwise with the shared [Worker.Key].
+type Worker struct {
+	Master string // e.g. "http://127.0.0.1:8080/"
+	ID     string
+	Key    string
+	KeyID  string
+	Secret string
+	Script Script
+	Client *http.Client
+	// the protocol it speaks, [models.CurrentProtocol] if it is 0
+	Protocol int
+
+	mux sync.Mutex
+	// how many times each page has been rendered
+	checks map[string]int
+}
+
+type response struct {
+	Code   int             `json:"code"`
+	Detail string          `json:"detail"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func (w *Worker) post(path string, query url.Values, contentType string, body []byte) (*response, error) {
+	u := strings.TrimSuffix(w.Master, "/") + "/v1/worker/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("WS-Worker-ID", w.ID)
+	if w.KeyID != "" {
+		err = w.sign(req, body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req.Header.Set("WS-Worker-Key", w.Key)
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%v: %v", path, resp.Status)
+	}
+
+	var r response
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &r, nil
+}
+
+// sign adds the headers checked by [middlewares.WorkerAuth]
+func (w *Worker) sign(req *http.Request, body []byte) error {
+	key, err := models.WorkerSigningKey(w.Secret)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	message := models.WorkerSignedMessage(req.Method, req.URL.RequestURI(), timestamp, body)
+
+	req.Header.Set("WS-Worker-Key-ID", w.KeyID)
+	req.Header.Set("WS-Timestamp", timestamp)
+	req.Header.Set("WS-Signature", hex.EncodeToString(ed25519.Sign(key, message)))
+	return nil
+}
+
+func (w *Worker) protocol() int {
+	if w.Protocol == 0 {
+		return models.CurrentProtocol
+	}
+	return w.Protocol
+}
+
+// Init registers the worker with all the features it can fake. A [models.ProtocolV1] worker sends neither its
+// protocol nor its features, like the workers before it.
+func (w *Worker) Init() error {
+	query := url.Values{}
+	query.Set("version", "fake")
+	if w.protocol() >= models.ProtocolV2 {
+		query.Set("protocol", strconv.Itoa(w.protocol()))
+		features := models.LegacyFeatures | models.FeatureMask([]string{models.FeatureText})
+		query.Set("capabilities", strings.Join(models.FeatureNames(features), ","))
+	}
+	r, err := w.post("init", query, "", nil)
+	if err != nil {
+		return err
+	}
+	if r.Code != 0 {
+		return errors.Errorf("init: code %d %v", r.Code, r.Detail)
+	}
+	return nil
+}
+
+// RunOnce fetches a task and submits the result. It returns false if there wasn't a task.
+func (w *Worker) RunOnce() (bool, error) {
+	r, err := w.post("fetch_task", nil, "", nil)
+	if err != nil {
+		return false, err
+	}
+	if r.Code != 0 {
+		return false, errors.Errorf("fetch_task: code %d %v", r.Code, r.Detail)
+	}
+	var data struct {
+		TaskID json.RawMessage  `json:"taskId"`
+		Task   *models.TaskSpec `json:"task"`
+	}
+	err = json.Unmarshal(r.Data, &data)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	taskID, err := w.parseTaskID(data.TaskID)
+	if err != nil {
+		return false, err
+	}
+	if taskID == "" || data.Task == nil {
+		return false, nil
+	}
+
+	query := url.Values{}
+	query.Set("taskId", taskID)
+	img, feedbackCode, feedbackMsg := w.Render(data.Task)
+	contentType := ""
+	var body []byte
+	if feedbackCode != 0 {
+		query.Set("feedback", strconv.Itoa(feedbackCode))
+		query.Set("msg", feedbackMsg)
+	} else {
+		b := &bytes.Buffer{}
+		mw := multipart.NewWriter(b)
+		var fw io.Writer
+		if data.Task.GetType() == models.TaskTypeText {
+			fw, err = mw.CreateFormFile("text", "text.txt")
+		} else {
+			fw, err = mw.CreateFormFile("image", "image."+data.Task.Output.Type)
+		}
+		if err != nil {
+			return true, errors.WithStack(err)
+		}
+		_, err = fw.Write(img)
+		if err != nil {
+			return true, errors.WithStack(err)
+		}
+		err = mw.Close()
+		if err != nil {
+			return true, errors.WithStack(err)
+		}
+		contentType = mw.FormDataContentType()
+		body = b.Bytes()
+	}
+
+	r, err = w.post("submit_task", query, contentType, body)
+	if err != nil {
+		return true, err
+	}
+	if r.Code != 0 {
+		return true, errors.Errorf("submit_task %v: code %d %v", taskID, r.Code, r.Detail)
+	}
+	return true, nil
+}
+
+// parseTaskID returns the task ID to send back, a number for [models.ProtocolV1] and a string since
+// [models.ProtocolV2]. It is empty if there isn't a task.
+func (w *Worker) parseTaskID(data json.RawMessage) (string, error) {
+	if w.protocol() < models.ProtocolV2 {
+		// read as a float64 like the JavaScript workers do
+		var id float64
+		err := json.Unmarshal(data, &id)
+		if err != nil || id == -1 {
+			return "", errors.WithStack(err)
+		}
+		return strconv.FormatFloat(id, 'f', -1, 64), nil
+	}
+	var id *string
+	err := json.Unmarshal(data, &id)
+	if err != nil || id == nil {
+		return "", errors.WithStack(err)
+	}
+	return *id, nil
+}
+
+// Run keeps running tasks until [ctx] is done. Errors are reported to [onError] and retried after a while.
+func (w *Worker) Run(ctx context.Context, onError func(error)) {
+	for ctx.Err() == nil {
+		_, err := w.RunOnce()
+		if err != nil {
+			onError(err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// Render returns the image (or the text of a text task) of the page according to the script, or the feedback if it
+// fails.
+func (w *Worker) Render(task *models.TaskSpec) (data []byte, feedbackCode int, feedbackMsg string) {
+	rule, ok := w.Script[task.URL]
+	if !ok {
+		rule = Rule{Behavior: Unchanged}
+	}
+	if rule.Behavior == Fail {
+		return nil, rule.FeedbackCode, rule.FeedbackMsg
+	}
+
+	w.mux.Lock()
+	if w.checks == nil {
+		w.checks = make(map[string]int)
+	}
+	checks := w.checks[task.URL]
+	w.checks[task.URL]++
+	w.mux.Unlock()
+
+	version := 0
+	if rule.Behavior == ChangedAfter && checks >= rule.After {
+		version = 1
+	}
+
+	if task.GetType() == models.TaskTypeText {
+		return pageText(task.Selector, version), 0, ""
+	}
+
+	width, height := task.Viewport.Width, fullPageHeight
+	if task.Clip != nil {
+		width, height = task.Clip.Width, task.Clip.Height
+	}
+	if rule.Behavior == ResizedAfter && checks >= rule.After {
+		height /= 2
+	}
+	img := pageImage(task.URL, version, width, height)
+	if version == 1 && rule.Area != nil {
+		img = pageImage(task.URL, 0, width, height)
+		area := rule.Area.Rectangle()
+		if task.Clip != nil {
+			area = area.Sub(image.Pt(task.Clip.X, task.Clip.Y))
+		}
+		draw.Draw(img, area, pageImage(task.URL, 1, width, height), area.Min, draw.Src)
+	}
+
+	b := &bytes.Buffer{}
+	var err error
+	if task.Output.Type == "jpg" {
+		err = jpeg.Encode(b, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(b, img)
+	}
+	if err != nil {
+		return nil, 1, fmt.Sprintf("fake worker: %v", err)
+	}
+	return b.Bytes(), 0, ""
+}
+
+// pageText lists five items of the selector, a version drops the first item and adds a new one at the end
+func pageText(selector string, version int) []byte {
+	b := &bytes.Buffer{}
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(b, "%s item %d\n", selector, i+version)
+	}
+	return b.Bytes()
+}
+
+// pageImage draws stripes whose colors are derived from the URL and the version
+func pageImage(u string, version int, width int, height int) *image.NRGBA {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(u))
+	seed := h.Sum32()
+	fg := color.NRGBA{R: uint8(seed), G: uint8(seed >> 8), B: uint8(seed >> 16), A: 255}
+	// far enough from the foreground in every channel
+	bg := color.NRGBA{R: fg.R ^ 0x80, G: fg.G ^ 0x80, B: fg.B ^ 0x80, A: 255}
+	if version%2 == 1 {
+		fg, bg = bg, fg
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		c := bg
+		if (y/8)%2 == 0 {
+			c = fg
+		}
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
@@ -1,25 +1,41 @@
 from typing import *
+import sqlite3
 import psycopg2
 
 
 class DBHelper:
-    def __init__(self, conn_str: str) -> None:
-        self._conn = psycopg2.connect(conn_str)
+    def __init__(self, conn_str: str, db_type: str) -> None:
+        self._db_type = db_type
+        if db_type == "sqlite":
+            self._conn = sqlite3.connect(conn_str)
+        else:
+            self._conn = psycopg2.connect(conn_str)
 
     def drop_all_tables(self) -> None:
         print("drop all tables")
         cur = self._conn.cursor()
-        cur.execute("DROP SCHEMA public CASCADE;")
-        cur.execute("CREATE SCHEMA public;")
-        cur.execute("GRANT ALL ON SCHEMA public TO postgres;")
-        cur.execute("GRANT ALL ON SCHEMA public TO public;")
+        if self._db_type == "sqlite":
+            cur.execute(
+                "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+            for (name,) in cur.fetchall():
+                cur.execute('DROP TABLE "{}"'.format(name))
+        else:
+            cur.execute("DROP SCHEMA public CASCADE;")
+            cur.execute("CREATE SCHEMA public;")
+            cur.execute("GRANT ALL ON SCHEMA public TO postgres;")
+            cur.execute("GRANT ALL ON SCHEMA public TO public;")
         self._conn.commit()
         cur.close()
 
     def get_email_verification_code(self, email: str) -> str:
         cur = self._conn.cursor()
-        cur.execute(
-            "SELECT verification_code FROM email_verifications WHERE email = %s AND expired_at > now()", (email,))
+        if self._db_type == "sqlite":
+            # the time is stored as text, let the service filter out the expired ones
+            cur.execute(
+                "SELECT verification_code FROM email_verifications WHERE email = ? ORDER BY expired_at DESC", (email,))
+        else:
+            cur.execute(
+                "SELECT verification_code FROM email_verifications WHERE email = %s AND expired_at > now()", (email,))
         data = cur.fetchone()
         self._conn.commit()
         cur.close()
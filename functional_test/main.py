@@ -29,6 +29,9 @@ def main() -> None:
         description='Functional test')
     parser.add_argument('--db', type=str,
                         help='db connection string')
+    parser.add_argument('--db_type', type=str, default='postgres',
+                        choices=['postgres', 'sqlite'],
+                        help='db type, "postgres" by default')
     parser.add_argument('--skip_clean_db', type=bool,
                         help='db will be cleaned by default')
     parser.add_argument('--port', type=int,
@@ -41,7 +44,7 @@ def main() -> None:
     print(Bcolors.OKBLUE, args, Bcolors.ENDC)
 
     start = time.time()
-    ok = run_test(args.db, args.skip_clean_db, args.port)
+    ok = run_test(args.db, args.db_type, args.skip_clean_db, args.port)
     print()
     print("=" * 40)
     print("Time used: {:.2f}s".format(time.time() - start))
@@ -52,7 +55,7 @@ def main() -> None:
         sys.exit(1)
 
 
-def run_test(db: str, skip_clean_db: bool, port: int) -> bool:
+def run_test(db: str, db_type: str, skip_clean_db: bool, port: int) -> bool:
     root_path = os.path.dirname(os.path.dirname(os.path.realpath(__file__)))
     os.chdir(root_path)
     tmp_dir = tempfile.TemporaryDirectory()
@@ -62,8 +65,8 @@ def run_test(db: str, skip_clean_db: bool, port: int) -> bool:
     service_url = "http://127.0.0.1:{}/".format(port)
 
     try:
-        db_helper = DBHelper(db)
-        build_config(tmp_dir.name, db, port)
+        db_helper = DBHelper(db, db_type)
+        build_config(tmp_dir.name, db, db_type, port)
         if not skip_clean_db:
             db_helper.drop_all_tables()
         service_p = start_service(tmp_dir.name)
@@ -104,13 +107,13 @@ def run_test(db: str, skip_clean_db: bool, port: int) -> bool:
     return is_ok
 
 
-def build_config(tmp_path: str, db: str, port: int) -> None:
+def build_config(tmp_path: str, db: str, db_type: str, port: int) -> None:
     config = {
         "releaseMode": False,
         "addr": "127.0.0.1:{}".format(port),
         "database": {
             "dataSourceName": db,
-            "type": "postgres"
+            "type": db_type
         },
         "verificationEmail": {
             "server": "your_smtp_server",
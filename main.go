@@ -24,6 +24,11 @@ func main() {
 				Usage:   "Load configuration from `FILE`",
 			},
 		},
+		Commands: []*cli.Command{
+			migrateCommand,
+			workerKeyCommand,
+			fakeWorkerCommand,
+		},
 		Action: start,
 		Usage:  "master server for websentry",
 	}
@@ -0,0 +1,20 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/websentry/websentry/controllers"
+)
+
+var adminKey string
+
+func AdminAuth(c *gin.Context) {
+	if adminKey == "" || c.GetHeader("WS-Admin-Key") != adminKey {
+
+		controllers.JSONResponse(c, controllers.CodeAuthError, "", nil)
+
+		c.Abort()
+		return
+	}
+	c.Next()
+}
@@ -5,4 +5,7 @@ import "github.com/websentry/websentry/config"
 func Init() {
 	// workerAuth
 	workerKey = config.GetConfig().WorkerKey
+	workerKeyWithCredentials = !config.GetConfig().DisableWorkerKeyWithCredentials
+	// adminAuth
+	adminKey = config.GetConfig().AdminKey
 }
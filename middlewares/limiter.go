@@ -1,15 +1,18 @@
 package middlewares
 
 import (
+	"context"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ulule/limiter/v3"
 	limitergin "github.com/ulule/limiter/v3/drivers/middleware/gin"
+	"github.com/ulule/limiter/v3/drivers/store/common"
 	"github.com/ulule/limiter/v3/drivers/store/memory"
 
 	"github.com/websentry/websentry/controllers"
+	"github.com/websentry/websentry/models"
 )
 
 func limitReachedHandler(c *gin.Context) {
@@ -26,6 +29,53 @@ func keyGetterUserID(c *gin.Context) string {
 
 // TODO: use redis
 
+// dbStore keeps the counters in the database, so that a limit is shared by all masters. The period of the rate
+// can't be longer than [models.MaxRateLimitPeriod].
+type dbStore struct {
+	prefix string
+}
+
+func (s dbStore) window(key string, rate limiter.Rate) (string, time.Time) {
+	return s.prefix + ":" + key, time.Now().Truncate(rate.Period)
+}
+
+func (s dbStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	key, start := s.window(key, rate)
+	var hits int64
+	err := models.Transaction(func(tx models.TX) (err error) {
+		hits, err = tx.IncrementRateLimit(key, start)
+		return
+	})
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	return common.GetContextFromState(time.Now(), rate, start.Add(rate.Period), hits), nil
+}
+
+func (s dbStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	key, start := s.window(key, rate)
+	var hits int64
+	err := models.Transaction(func(tx models.TX) (err error) {
+		hits, err = tx.GetRateLimit(key, start)
+		return
+	})
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	return common.GetContextFromState(time.Now(), rate, start.Add(rate.Period), hits), nil
+}
+
+func (s dbStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	key, start := s.window(key, rate)
+	err := models.Transaction(func(tx models.TX) error {
+		return tx.ResetRateLimit(key, start)
+	})
+	if err != nil {
+		return limiter.Context{}, err
+	}
+	return common.GetContextFromState(time.Now(), rate, start.Add(rate.Period), 0), nil
+}
+
 func GetSensitiveLimiter() gin.HandlerFunc {
 	store := memory.NewStore()
 	rate := limiter.Rate{
@@ -77,3 +127,17 @@ func GetWorkerLimiter() gin.HandlerFunc {
 	}
 	return limitergin.NewMiddleware(limiter.New(store, rate), options...)
 }
+
+// GetCheckNowLimiter is shared by all masters, a user can't check more often by reaching several of them
+func GetCheckNowLimiter() gin.HandlerFunc {
+	store := dbStore{prefix: "checkNow"}
+	rate := limiter.Rate{
+		Period: 1 * time.Hour,
+		Limit:  30,
+	}
+	options := []limitergin.Option{
+		limitergin.WithKeyGetter(keyGetterUserID),
+		limitergin.WithLimitReachedHandler(limitReachedHandler),
+	}
+	return limitergin.NewMiddleware(limiter.New(store, rate), options...)
+}
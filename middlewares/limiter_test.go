@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/websentry/websentry/controllers"
+)
+
+func TestCheckNowLimiter(t *testing.T) {
+	// two masters sharing the database
+	var routers []*gin.Engine
+	for i := 0; i < 2; i++ {
+		r := gin.New()
+		r.POST("/v1/sentry/check_now", func(c *gin.Context) {
+			c.Set("userId", int64(42))
+		}, GetCheckNowLimiter(), func(c *gin.Context) {
+			controllers.JSONResponse(c, controllers.CodeOK, "", nil)
+		})
+		routers = append(routers, r)
+	}
+	send := func(r *gin.Engine) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/sentry/check_now", nil))
+		var resp struct {
+			Code int `json:"code"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code
+	}
+
+	for i := 0; i < 30; i++ {
+		if code := send(routers[i%2]); code != controllers.CodeOK {
+			t.Fatalf("check %d is limited: %d", i, code)
+		}
+	}
+	for _, r := range routers {
+		if code := send(r); code != controllers.CodeExceededLimits {
+			t.Errorf("the limit is not shared: %d", code)
+		}
+	}
+}
@@ -1,20 +1,159 @@
 package middlewares
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/websentry/websentry/controllers"
+	"github.com/websentry/websentry/models"
 )
 
+// the largest body of a signed request, it has to be read to check the signature
+const maxSignedBodySize = 32 << 20
+
+// the shared key of older workers, disabled if it is empty
 var workerKey string
 
+// whether the shared key is accepted while a credential is active
+var workerKeyWithCredentials = true
+
+// WorkerAuth accepts either a signed request of a worker credential or the shared worker key.
+//
+// A signed request has these headers:
+//
+//	WS-Worker-Key-ID: the public key ID of the credential
+//	WS-Timestamp:     unix time in seconds
+//	WS-Signature:     hex(Ed25519(key, method + "\n" + request uri + "\n" + timestamp + "\n" + hex(sha256(body))))
+//
+// where key is derived from the secret, which is the seed of the key. Only the public key is stored, see
+// [models.WorkerSigningKey]. A signature is only accepted once by all the masters.
+//
+// Workers using the shared key choose their own ID, it gets [models.SharedKeyWorkerPrefix].
 func WorkerAuth(c *gin.Context) {
-	if c.GetHeader("WS-Worker-Key") != workerKey {
+	if c.GetHeader("WS-Worker-Key-ID") != "" {
+		workerAuthCredential(c)
+		return
+	}
+
+	if workerKey == "" || c.GetHeader("WS-Worker-Key") != workerKey {
 
 		controllers.JSONResponse(c, controllers.CodeAuthError, "", nil)
 
 		c.Abort()
 		return
 	}
+	if !workerKeyWithCredentials {
+		var active bool
+		err := models.Transaction(func(tx models.TX) (err error) {
+			active, err = tx.HasActiveWorkerCredentials()
+			return
+		})
+		if err != nil {
+			controllers.InternalErrorResponse(c, err)
+			c.Abort()
+			return
+		}
+		if active {
+			controllers.JSONResponse(c, controllers.CodeAuthError, "Shared key is disabled", nil)
+			c.Abort()
+			return
+		}
+	}
+	c.Set("workerId", controllers.SharedKeyWorkerID(c))
+	c.Next()
+}
+
+func workerAuthCredential(c *gin.Context) {
+	abort := func(detail string) {
+		controllers.JSONResponse(c, controllers.CodeAuthError, detail, nil)
+		c.Abort()
+	}
+
+	timestamp := c.GetHeader("WS-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		abort("Invalid timestamp")
+		return
+	}
+	signedAt := time.Unix(unix, 0)
+	if time.Since(signedAt) > models.WorkerSignatureMaxAge || time.Until(signedAt) > models.WorkerSignatureMaxAge {
+		abort("Request expired")
+		return
+	}
+	signature, err := hex.DecodeString(c.GetHeader("WS-Signature"))
+	if err != nil {
+		abort("Invalid signature")
+		return
+	}
+
+	var credential *models.WorkerCredential
+	err = models.Transaction(func(tx models.TX) (err error) {
+		credential, err = tx.GetWorkerCredential(c.GetHeader("WS-Worker-Key-ID"))
+		return
+	})
+	if err != nil {
+		if models.IsErrNoDocument(err) {
+			abort("Unknown key")
+		} else {
+			controllers.InternalErrorResponse(c, err)
+			c.Abort()
+		}
+		return
+	}
+	if credential.Revoked || (credential.ExpireAt != nil && credential.ExpireAt.Before(time.Now())) {
+		abort("Key is revoked or expired")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodySize))
+	if err != nil {
+		abort("Failed to read the body")
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	message := models.WorkerSignedMessage(c.Request.Method, c.Request.RequestURI, timestamp, body)
+	if !credential.VerifyWorkerSignature(message, signature) {
+		abort("Invalid signature")
+		return
+	}
+	var unused bool
+	err = models.Transaction(func(tx models.TX) (err error) {
+		unused, err = tx.UseWorkerSignature(hex.EncodeToString(signature))
+		return
+	})
+	if err != nil {
+		controllers.InternalErrorResponse(c, err)
+		c.Abort()
+		return
+	}
+	if !unused {
+		abort("Replayed request")
+		return
+	}
+
+	var scopes []string
+	err = json.Unmarshal([]byte(credential.Scopes), &scopes)
+	if err != nil {
+		controllers.InternalErrorResponse(c, err)
+		c.Abort()
+		return
+	}
+	modes := []models.TaskMode{}
+	for _, s := range scopes {
+		if m, ok := models.ScopeTaskMode(s); ok {
+			modes = append(modes, m)
+		}
+	}
+
+	c.Set("workerId", credential.Name)
+	c.Set("workerModes", modes)
 	c.Next()
 }
@@ -0,0 +1,209 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/websentry/websentry/controllers"
+	"github.com/websentry/websentry/models"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		panic(err)
+	}
+	// an in-memory database only lives in a single connection
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	err = models.Init(db, 1)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestWorkerAuthCredential(t *testing.T) {
+	secret := strings.Repeat("01", ed25519.SeedSize)
+	publicKey, err := models.WorkerPublicKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := models.WorkerSigningKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	err = models.Transaction(func(tx models.TX) error {
+		err := tx.CreateWorkerCredential(&models.WorkerCredential{ID: "key-a", Name: "worker-a", PublicKey: publicKey,
+			Scopes: `["sentry"]`})
+		if err != nil {
+			return err
+		}
+		return tx.CreateWorkerCredential(&models.WorkerCredential{ID: "key-revoked", Name: "worker-revoked",
+			PublicKey: publicKey, Scopes: `["sentry"]`, Revoked: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/v1/worker/init", WorkerAuth, func(c *gin.Context) {
+		controllers.JSONResponse(c, controllers.CodeOK, "", gin.H{"workerId": c.GetString("workerId")})
+	})
+	send := func(keyID string, signingKey ed25519.PrivateKey, signedAt time.Time, body string, sent string) int {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		uri := "/v1/worker/init?version=1"
+		message := models.WorkerSignedMessage(http.MethodPost, uri, timestamp, []byte(body))
+		req := httptest.NewRequest(http.MethodPost, uri, bytes.NewReader([]byte(sent)))
+		req.Header.Set("WS-Worker-Key-ID", keyID)
+		req.Header.Set("WS-Timestamp", timestamp)
+		req.Header.Set("WS-Signature", hex.EncodeToString(ed25519.Sign(signingKey, message)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Code int `json:"code"`
+			Data struct {
+				WorkerID string `json:"workerId"`
+			} `json:"data"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code == controllers.CodeOK && resp.Data.WorkerID != "worker-a" {
+			t.Errorf("unexpected worker: %v", resp.Data.WorkerID)
+		}
+		return resp.Code
+	}
+
+	now := time.Now()
+	for _, c := range []struct {
+		name       string
+		keyID      string
+		signingKey ed25519.PrivateKey
+		signedAt   time.Time
+		body       string
+		sent       string
+		code       int
+	}{
+		{"valid", "key-a", key, now, "body", "body", controllers.CodeOK},
+		{"replayed", "key-a", key, now, "body", "body", controllers.CodeAuthError},
+		{"another body", "key-a", key, now, "body 2", "body 2", controllers.CodeOK},
+		{"modified body", "key-a", key, now, "body 3", "body 4", controllers.CodeAuthError},
+		{"other key", "key-a", otherKey, now, "body 5", "body 5", controllers.CodeAuthError},
+		{"stale", "key-a", key, now.Add(-2 * models.WorkerSignatureMaxAge), "body", "body", controllers.CodeAuthError},
+		{"future", "key-a", key, now.Add(2 * models.WorkerSignatureMaxAge), "body", "body", controllers.CodeAuthError},
+		{"unknown key", "key-b", key, now, "body 6", "body 6", controllers.CodeAuthError},
+		{"revoked", "key-revoked", key, now, "body 7", "body 7", controllers.CodeAuthError},
+		{"too large", "key-a", key, now, "", strings.Repeat("a", maxSignedBodySize+1), controllers.CodeAuthError},
+	} {
+		if code := send(c.keyID, c.signingKey, c.signedAt, c.body, c.sent); code != c.code {
+			t.Errorf("%v: unexpected code %d", c.name, code)
+		}
+	}
+}
+
+func TestWorkerAuthSharedKey(t *testing.T) {
+	defer func(key string) { workerKey = key }(workerKey)
+	workerKey = "test-key"
+	publicKey, err := models.WorkerPublicKey(strings.Repeat("02", ed25519.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.Transaction(func(tx models.TX) error {
+		return tx.CreateWorkerCredential(&models.WorkerCredential{ID: "key-shared", Name: "worker-shared",
+			PublicKey: publicKey, Scopes: `["fullScreenshot"]`})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/v1/worker/init", WorkerAuth, func(c *gin.Context) {
+		controllers.JSONResponse(c, controllers.CodeOK, "", gin.H{"workerId": c.GetString("workerId")})
+	})
+	send := func(key string, id string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/worker/init", nil)
+		req.Header.Set("WS-Worker-Key", key)
+		if id != "" {
+			req.Header.Set("WS-Worker-ID", id)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Code int `json:"code"`
+			Data struct {
+				WorkerID string `json:"workerId"`
+			} `json:"data"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code, resp.Data.WorkerID
+	}
+
+	for _, c := range []struct {
+		name     string
+		key      string
+		id       string
+		code     int
+		workerID string
+	}{
+		{"own ID", "test-key", "worker-1", controllers.CodeOK, "key:worker-1"},
+		// it can't act as the worker of a credential
+		{"name of a credential", "test-key", "worker-shared", controllers.CodeOK, "key:worker-shared"},
+		{"without ID", "test-key", "", controllers.CodeOK, "key:192.0.2.1"},
+		{"wrong key", "other-key", "worker-1", controllers.CodeAuthError, ""},
+	} {
+		code, workerID := send(c.key, c.id)
+		if code != c.code || workerID != c.workerID {
+			t.Errorf("%v: unexpected response %d %q", c.name, code, workerID)
+		}
+	}
+
+	// the shared key is disabled while a credential is active
+	defer func() { workerKeyWithCredentials = true }()
+	workerKeyWithCredentials = false
+	if code, _ := send("test-key", "worker-1"); code != controllers.CodeAuthError {
+		t.Errorf("the shared key is accepted with active credentials: %d", code)
+	}
+	err = models.Transaction(func(tx models.TX) error {
+		credentials, err := tx.GetWorkerCredentials()
+		if err != nil {
+			return err
+		}
+		for _, c := range credentials {
+			err = tx.RevokeWorkerCredential(c.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := send("test-key", "worker-1"); code != controllers.CodeOK {
+		t.Errorf("the shared key is rejected without active credentials: %d", code)
+	}
+}
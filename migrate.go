@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/websentry/websentry/models"
+	"github.com/websentry/websentry/server"
+)
+
+var migrateCommand = &cli.Command{
+	Name:  "migrate",
+	Usage: "manage database migrations without starting the server",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "status",
+			Usage:  "list all migrations and whether they are applied",
+			Action: migrateStatus,
+		},
+		{
+			Name:      "up",
+			Usage:     "apply the next n pending migrations, all of them by default",
+			ArgsUsage: "[n]",
+			Action:    migrateUp,
+		},
+		{
+			Name:      "down",
+			Usage:     "roll back the last n applied migrations, 1 by default",
+			ArgsUsage: "[n]",
+			Action:    migrateDown,
+		},
+	},
+}
+
+func parseMigrationCount(c *cli.Context, defaultValue int) (int, error) {
+	if c.Args().Len() == 0 {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(c.Args().First())
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid number of migrations: %v", c.Args().First())
+	}
+	return n, nil
+}
+
+func migrateStatus(c *cli.Context) error {
+	err := server.InitDB(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	status, err := models.GetMigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, s := range status {
+		appliedAt := "pending"
+		if s.AppliedAt != nil {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-19s  %s\n", s.Version, appliedAt, s.Name)
+	}
+	return nil
+}
+
+func migrateUp(c *cli.Context) error {
+	n, err := parseMigrationCount(c, 0)
+	if err != nil {
+		return err
+	}
+	err = server.InitDB(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	applied, err := models.MigrateUp(n)
+	for _, v := range applied {
+		fmt.Printf("applied migration %d\n", v)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("no pending migration")
+	}
+	return nil
+}
+
+func migrateDown(c *cli.Context) error {
+	n, err := parseMigrationCount(c, 1)
+	if err != nil {
+		return err
+	}
+	err = server.InitDB(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	rolledBack, err := models.MigrateDown(n)
+	for _, v := range rolledBack {
+		fmt.Printf("rolled back migration %d\n", v)
+	}
+	if err != nil {
+		return err
+	}
+	if len(rolledBack) == 0 {
+		fmt.Println("no applied migration")
+	}
+	return nil
+}
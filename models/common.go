@@ -15,13 +15,26 @@ type TX struct {
 	tx *gorm.DB
 }
 
-func Init(db *gorm.DB) (err error) {
+// Init connects the models to [db] and applies all pending migrations.
+// [nodeID] is used to generate IDs, it must be unique among masters sharing the same database.
+func Init(db *gorm.DB, nodeID int64) (err error) {
+	err = InitWithoutMigration(db, nodeID)
+	if err != nil {
+		return
+	}
+	_, err = MigrateUp(0)
+	return
+}
+
+// InitWithoutMigration connects the models to [db], the schema is left as it is
+func InitWithoutMigration(db *gorm.DB, nodeID int64) (err error) {
 	gDB = db
-	snowflakeNode, err = snowflake.NewNode(1)
+	snowflakeNode, err = snowflake.NewNode(nodeID)
 	if err != nil {
 		return
 	}
-	return migrate()
+	taskIDs = &taskIDNode{node: nodeID}
+	return
 }
 
 func IsErrNoDocument(err error) bool {
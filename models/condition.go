@@ -0,0 +1,175 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// types of [Condition], they are evaluated on the text of a text sentry
+const (
+	// [Condition.Keyword] is in the text
+	ConditionKeywordAppears = "keywordAppears"
+	// [Condition.Keyword] is not in the text
+	ConditionKeywordDisappears = "keywordDisappears"
+	// [Condition.Pattern] matches the text
+	ConditionRegexMatches = "regexMatches"
+	// the number extracted by [Condition.Pattern] is below [Condition.Value]
+	ConditionNumberBelow = "numberBelow"
+	// the number extracted by [Condition.Pattern] is above [Condition.Value]
+	ConditionNumberAbove = "numberAbove"
+)
+
+// how [Trigger.Conditions] are combined
+const (
+	CombineAll = "all" // AND
+	CombineAny = "any" // OR
+)
+
+// MaxTriggerConditions is the maximum number of [Trigger.Conditions]
+const MaxTriggerConditions = 10
+
+// the maximum length of [Condition.Keyword] and [Condition.Pattern]
+const maxConditionLength = 1000
+
+// the number found by the number conditions if there isn't a [Condition.Pattern], e.g. "-1,299.50"
+var defaultNumberPattern = regexp.MustCompile(`-?\d[\d,]*(\.\d+)?`)
+
+// Condition is a state of the text, e.g. the price is below 100. A sentry with conditions is notified when the
+// combined state of the conditions becomes true, not when it stays true.
+type Condition struct {
+	Type    string `json:"type"`
+	Keyword string `json:"keyword,omitempty"`
+	// a regular expression (RE2 syntax). For the number conditions, the number is its first group (or the whole
+	// match if it hasn't any), the first number of the text if the pattern is empty.
+	Pattern string  `json:"pattern,omitempty"`
+	Value   float64 `json:"value,omitempty"`
+
+	// [Condition.Pattern] compiled by [Condition.Validate]
+	re *regexp.Regexp
+}
+
+// Validate checks the type and the fields it uses
+func (c *Condition) Validate() error {
+	switch c.Type {
+	case ConditionKeywordAppears, ConditionKeywordDisappears:
+		if c.Keyword == "" || len(c.Keyword) > maxConditionLength {
+			return errors.Wrap(ErrInvalidTrigger, "invalid keyword")
+		}
+	case ConditionRegexMatches, ConditionNumberBelow, ConditionNumberAbove:
+		if len(c.Pattern) > maxConditionLength || (c.Type == ConditionRegexMatches && c.Pattern == "") {
+			return errors.Wrap(ErrInvalidTrigger, "invalid pattern")
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return errors.Wrap(ErrInvalidTrigger, err.Error())
+		}
+		c.re = re
+	default:
+		return errors.Wrapf(ErrInvalidTrigger, "unknown condition %q", c.Type)
+	}
+	return nil
+}
+
+// Evaluate returns whether the condition is met by the text, and the value it is evaluated on: the keyword, the
+// match of the pattern or the extracted number. [value] is empty if nothing is found. The condition must have been
+// validated.
+func (c *Condition) Evaluate(text string) (met bool, value string, err error) {
+	isNumber := c.Type == ConditionNumberBelow || c.Type == ConditionNumberAbove
+	if c.re == nil && (c.Type == ConditionRegexMatches || (isNumber && c.Pattern != "")) {
+		return false, "", errors.Errorf("condition is not validated: %v", c.String())
+	}
+	switch c.Type {
+	case ConditionKeywordAppears, ConditionKeywordDisappears:
+		found := strings.Contains(text, c.Keyword)
+		if found {
+			value = c.Keyword
+		}
+		return found == (c.Type == ConditionKeywordAppears), value, nil
+	case ConditionRegexMatches:
+		loc := c.re.FindStringIndex(text)
+		if loc == nil {
+			return false, "", nil
+		}
+		return true, text[loc[0]:loc[1]], nil
+	case ConditionNumberBelow, ConditionNumberAbove:
+		value = c.extractNumber(text)
+		n, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64)
+		if err != nil {
+			return false, value, nil
+		}
+		if c.Type == ConditionNumberBelow {
+			return n < c.Value, value, nil
+		}
+		return n > c.Value, value, nil
+	}
+	return false, "", errors.Wrapf(ErrInvalidTrigger, "unknown condition %q", c.Type)
+}
+
+func (c *Condition) extractNumber(text string) string {
+	if c.Pattern == "" {
+		return defaultNumberPattern.FindString(text)
+	}
+	m := c.re.FindStringSubmatch(text)
+	if len(m) == 0 {
+		return ""
+	}
+	if len(m) > 1 {
+		return strings.TrimSpace(m[1])
+	}
+	return strings.TrimSpace(m[0])
+}
+
+// String describes the condition, e.g. `number below 100`
+func (c *Condition) String() string {
+	switch c.Type {
+	case ConditionKeywordAppears:
+		return fmt.Sprintf("keyword %q appears", c.Keyword)
+	case ConditionKeywordDisappears:
+		return fmt.Sprintf("keyword %q disappears", c.Keyword)
+	case ConditionRegexMatches:
+		return fmt.Sprintf("regex %q matches", c.Pattern)
+	case ConditionNumberBelow:
+		return fmt.Sprintf("number below %v", c.Value)
+	case ConditionNumberAbove:
+		return fmt.Sprintf("number above %v", c.Value)
+	}
+	return c.Type
+}
+
+// ConditionResult is a [Condition] evaluated on a text
+type ConditionResult struct {
+	Condition *Condition
+	Met       bool
+	Value     string
+}
+
+// EvaluateConditions evaluates [Trigger.Conditions] on the text, [met] is their combined state
+func (t *Trigger) EvaluateConditions(text string) (met bool, results []ConditionResult, err error) {
+	met = t.GetCombine() == CombineAll
+	for i := range t.Conditions {
+		r := ConditionResult{Condition: &t.Conditions[i]}
+		r.Met, r.Value, err = r.Condition.Evaluate(text)
+		if err != nil {
+			return false, nil, err
+		}
+		results = append(results, r)
+		if t.GetCombine() == CombineAll {
+			met = met && r.Met
+		} else {
+			met = met || r.Met
+		}
+	}
+	return
+}
+
+// GetCombine returns [Trigger.Combine], or [CombineAll] if it is empty
+func (t *Trigger) GetCombine() string {
+	if t.Combine == "" {
+		return CombineAll
+	}
+	return t.Combine
+}
@@ -1,19 +1,78 @@
 package models
 
-import "database/sql/driver"
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+)
 
 type RunningState int64
 
 const (
 	RSRunning RunningState = 1
 	RSPaused  RunningState = -1
+	// paused automatically after too many consecutive failed checks
+	RSError RunningState = -2
 )
 
 func (p *RunningState) Scan(value interface{}) error {
-	*p = RunningState(value.(int64))
-	return nil
+	v, err := scanInt64(value)
+	*p = RunningState(v)
+	return err
 }
 
 func (p RunningState) Value() (driver.Value, error) {
 	return int64(p), nil
 }
+
+type TaskMode int64
+
+const (
+	TMFullScreenshot TaskMode = 0
+	TMSentry         TaskMode = 1
+)
+
+func (p *TaskMode) Scan(value interface{}) error {
+	v, err := scanInt64(value)
+	*p = TaskMode(v)
+	return err
+}
+
+func (p TaskMode) Value() (driver.Value, error) {
+	return int64(p), nil
+}
+
+type TaskState int64
+
+const (
+	TSQueued    TaskState = 1
+	TSAssigned  TaskState = 2
+	TSCompleted TaskState = 3
+	TSFailed    TaskState = 4
+	// the result of a sentry task requested by a user has been compared and is kept for a while
+	TSProcessed TaskState = 5
+	// the sentry was paused or removed, a worker running it is told to stop
+	TSCancelled TaskState = 6
+)
+
+func (p *TaskState) Scan(value interface{}) error {
+	v, err := scanInt64(value)
+	*p = TaskState(v)
+	return err
+}
+
+func (p TaskState) Value() (driver.Value, error) {
+	return int64(p), nil
+}
+
+func scanInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		// MySQL returns integers as text if the query is not prepared
+		return strconv.ParseInt(string(v), 10, 64)
+	default:
+		return 0, fmt.Errorf("unsupported type for enum: %T", value)
+	}
+}
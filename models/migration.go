@@ -1,83 +1,490 @@
 package models
 
 import (
+	"fmt"
 	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
 )
 
-func migrate() error {
-	return Transaction(func(t TX) (err error) {
-		err = t.tx.AutoMigrate(&SystemSetting{})
-		if err != nil {
-			return
-		}
+// Note: MySQL commits DDL statements implicitly, so a failed migration there can't be fully rolled back.
 
-		var dbVersion SystemSetting
-		err = t.tx.FirstOrCreate(&dbVersion, SystemSetting{Key: "db_version"}).Error
-		if err != nil {
-			return
-		}
+var ErrIrreversibleMigration = errors.New("Migration can't be rolled back.")
 
-		dbVersionInt, _ := strconv.Atoi(dbVersion.Value)
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+	// nil if the migration can't be rolled back
+	down func(tx *gorm.DB) error
+}
 
-		if dbVersionInt == 0 {
-			err = t.tx.AutoMigrate(&User{}, &EmailVerification{}, &NotificationMethod{}, &Sentry{}, &SentryImage{})
+// Append new migrations to the end, versions must be consecutive starting from 1.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&User{}, &EmailVerification{}, &NotificationMethod{}, &Sentry{}, &SentryImage{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&User{}, &EmailVerification{}, &NotificationMethod{}, &Sentry{}, &SentryImage{})
+		},
+	},
+	{
+		version: 2,
+		name:    "notify count starts from 0",
+		up: func(tx *gorm.DB) error {
+			err := tx.Model(&Sentry{}).Where("notify_count = ?", -1).Update("notify_count", 0).Error
 			if err != nil {
-				return
+				return err
 			}
-		} else {
-			if dbVersionInt == 1 {
-				err = t.tx.Model(&Sentry{}).Where("notify_count = ?", -1).Update("notify_count", 0).Error
-				if err != nil {
-					return
-				}
-				err = t.tx.AutoMigrate(&User{}, &NotificationMethod{}, &Sentry{})
-				if err != nil {
-					return
-				}
-				dbVersionInt = 2
+			return tx.AutoMigrate(&User{}, &NotificationMethod{}, &Sentry{})
+		},
+		// sentries that were never checked can't be told apart anymore
+		down: nil,
+	},
+	{
+		version: 3,
+		name:    "drop remaining count of email verifications",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&EmailVerification{})
+			if err != nil {
+				return err
 			}
-
-			if dbVersionInt == 2 {
-				err = t.tx.AutoMigrate(&EmailVerification{})
-				if err != nil {
-					return
-				}
-				err = t.tx.Table("email_verifications").Migrator().DropColumn(&EmailVerification{}, "remaining_count")
+			// MySQL fails on dropping a column that doesn't exist
+			if tx.Migrator().HasColumn(&EmailVerification{}, "remaining_count") {
+				return tx.Migrator().DropColumn(&EmailVerification{}, "remaining_count")
+			}
+			return nil
+		},
+		down: func(tx *gorm.DB) error {
+			type emailVerification struct {
+				RemainingCount int
+			}
+			return tx.Table("email_verifications").Migrator().AddColumn(&emailVerification{}, "RemainingCount")
+		},
+	},
+	{
+		version: 4,
+		name:    "user language and time zone",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&User{})
+			if err != nil {
+				return err
+			}
+			return tx.Model(&User{}).Where("1 = 1").Updates(&User{
+				Language: "en-US",
+				TimeZone: "Asia/Shanghai",
+			}).Error
+		},
+		down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropColumn(&User{}, "language")
+			if err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&User{}, "time_zone")
+		},
+	},
+	{
+		version: 5,
+		name:    "sentry running state",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&Sentry{})
+			if err != nil {
+				return err
+			}
+			return tx.Model(&Sentry{}).Where("1 = 1").Updates(&Sentry{
+				RunningState: RSRunning,
+			}).Error
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&Sentry{}, "running_state")
+		},
+	},
+	{
+		version: 6,
+		name:    "durable task queue",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Task{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&Task{})
+		},
+	},
+	{
+		version: 7,
+		name:    "sentry failure tracking",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Sentry{})
+		},
+		down: func(tx *gorm.DB) error {
+			err := tx.Model(&Sentry{}).Where("running_state = ?", RSError).Update("running_state", RSPaused).Error
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"consecutive_failures", "last_error", "last_error_time"} {
+				err = tx.Migrator().DropColumn(&Sentry{}, column)
 				if err != nil {
-					return
+					return err
 				}
-				dbVersionInt = 3
 			}
-			if dbVersionInt == 3 {
-				err = t.tx.AutoMigrate(&User{})
+			return nil
+		},
+	},
+	{
+		version: 8,
+		name:    "sentry schedule",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Sentry{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&Sentry{}, "schedule")
+		},
+	},
+	{
+		version: 9,
+		name:    "per-host task limits",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&Task{})
+			if err != nil {
+				return err
+			}
+			return tx.Model(&Task{}).Where("1 = 1").Updates(map[string]interface{}{
+				"host":         "",
+				"available_at": gorm.Expr("created_at"),
+			}).Error
+		},
+		down: func(tx *gorm.DB) error {
+			// SQLite loses indexes when a column is dropped by copying the table
+			if tx.Migrator().HasIndex(&Task{}, "Host") {
+				err := tx.Migrator().DropIndex(&Task{}, "Host")
 				if err != nil {
-					return
+					return err
 				}
-				err = t.tx.Model(&User{}).Where("1 = 1").Updates(&User{
-					Language: "en-US",
-					TimeZone: "Asia/Shanghai",
-				}).Error
+			}
+			for _, column := range []string{"host", "available_at"} {
+				err := tx.Migrator().DropColumn(&Task{}, column)
 				if err != nil {
-					return
+					return err
 				}
-				dbVersionInt = 4
 			}
-			if dbVersionInt == 4 {
-				err = t.tx.AutoMigrate(&Sentry{})
+			return nil
+		},
+	},
+	{
+		version: 10,
+		name:    "task priority and check results",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&Task{})
+			if err != nil {
+				return err
+			}
+			return tx.Model(&Task{}).Where("1 = 1").Update("priority", 0).Error
+		},
+		down: func(tx *gorm.DB) error {
+			err := tx.Where("state = ?", TSProcessed).Delete(&Task{}).Error
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"priority", "similarity", "changed"} {
+				err = tx.Migrator().DropColumn(&Task{}, column)
 				if err != nil {
-					return
+					return err
 				}
-				err = t.tx.Model(&Sentry{}).Where("1 = 1").Updates(&Sentry{
-					RunningState: RSRunning,
-				}).Error
+			}
+			return nil
+		},
+	},
+	{
+		version: 11,
+		name:    "worker registry",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Worker{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&Worker{})
+		},
+	},
+	{
+		version: 12,
+		name:    "worker credentials",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&WorkerCredential{}, &WorkerSignature{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&WorkerCredential{}, &WorkerSignature{})
+		},
+	},
+	{
+		version: 13,
+		name:    "worker tags",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&Sentry{}, &Task{}, &Worker{})
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&Sentry{}).Where("1 = 1").Update("required_tags", "").Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&Task{}).Where("1 = 1").Update("required_tags", "").Error
+		},
+		down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropColumn(&Sentry{}, "required_tags")
+			if err != nil {
+				return err
+			}
+			err = tx.Migrator().DropColumn(&Task{}, "required_tags")
+			if err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&Worker{}, "tags")
+		},
+	},
+	{
+		version: 14,
+		name:    "snowflake task IDs",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().AlterColumn(&Task{}, "ID")
+		},
+		down: func(tx *gorm.DB) error {
+			// the tasks are requeued by the scheduler
+			err := tx.Where("1 = 1").Delete(&Task{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Migrator().AlterColumn(&task32{}, "ID")
+		},
+	},
+	{
+		version: 15,
+		name:    "worker protocol and task features",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&Task{}, &Worker{})
+			if err != nil {
+				return err
+			}
+			// queued tasks can be run by any worker
+			err = tx.Model(&Task{}).Where("1 = 1").Update("required_features", 0).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&Worker{}).Where("1 = 1").Updates(map[string]interface{}{
+				"protocol": 0,
+				"features": 0,
+			}).Error
+		},
+		down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropColumn(&Task{}, "required_features")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"protocol", "features"} {
+				err = tx.Migrator().DropColumn(&Worker{}, column)
 				if err != nil {
-					return
+					return err
 				}
-				// dbVersionInt = 5
 			}
+			return nil
+		},
+	},
+	{
+		version: 16,
+		name:    "diff images",
+		up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(&SentryImage{})
+			if err != nil {
+				return err
+			}
+			return tx.Model(&SentryImage{}).Where("1 = 1").Update("diff_file", "").Error
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&SentryImage{}, "diff_file")
+		},
+	},
+	{
+		version: 17,
+		name:    "rate limits",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&RateLimit{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&RateLimit{})
+		},
+	},
+}
+
+// task32 is the ID column of [Task] before migration 14
+type task32 struct {
+	ID int32 `gorm:"primaryKey;autoIncrement:false"`
+}
+
+func (task32) TableName() string {
+	return "tasks"
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil if it is pending
+}
+
+func prepareMigration() error {
+	return gDB.Transaction(func(tx *gorm.DB) (err error) {
+		err = tx.AutoMigrate(&SystemSetting{}, &SchemaMigration{})
+		if err != nil {
+			return
 		}
-		dbVersion.Value = "5"
 
-		return t.tx.Save(&dbVersion).Error
+		var count int64
+		err = tx.Model(&SchemaMigration{}).Count(&count).Error
+		if err != nil || count > 0 {
+			return
+		}
+
+		// Before the migrations were recorded one by one, there was only a "db_version" in system settings.
+		var dbVersion SystemSetting
+		err = tx.Where(&SystemSetting{Key: "db_version"}).Limit(1).Find(&dbVersion).Error
+		if err != nil {
+			return
+		}
+		v, _ := strconv.Atoi(dbVersion.Value)
+		now := time.Now()
+		for _, m := range migrations {
+			if m.version > v {
+				break
+			}
+			err = tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: now}).Error
+			if err != nil {
+				return
+			}
+		}
+		return
 	})
 }
+
+func currentVersion(tx *gorm.DB) (int, error) {
+	// [Find] instead of [First] to avoid logging "record not found" on an empty database
+	var last SchemaMigration
+	err := tx.Order("version DESC").Limit(1).Find(&last).Error
+	return last.Version, err
+}
+
+// the "db_version" is still kept for older versions of websentry
+func setDBVersion(tx *gorm.DB, version int) error {
+	return tx.Save(&SystemSetting{Key: "db_version", Value: strconv.Itoa(version)}).Error
+}
+
+// GetMigrationStatus lists all known migrations and when they were applied
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	err := prepareMigration()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaMigration
+	err = gDB.Order("version").Find(&applied).Error
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	appliedAt := make(map[int]time.Time)
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	results := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		results[i].Version = m.version
+		results[i].Name = m.name
+		if t, ok := appliedAt[m.version]; ok {
+			results[i].AppliedAt = &t
+		}
+	}
+	return results, nil
+}
+
+// MigrateUp applies at most [n] pending migrations, all of them if [n] <= 0.
+// It returns the versions that are applied.
+func MigrateUp(n int) ([]int, error) {
+	err := prepareMigration()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []int
+	for n <= 0 || len(applied) < n {
+		var version int
+		err = gDB.Transaction(func(tx *gorm.DB) (err error) {
+			version, err = currentVersion(tx)
+			if err != nil || version >= len(migrations) {
+				version = 0
+				return
+			}
+			m := migrations[version]
+			err = m.up(tx)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d (%s)", m.version, m.name)
+			}
+			err = tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+			if err != nil {
+				return
+			}
+			version = m.version
+			return setDBVersion(tx, version)
+		})
+		if err != nil {
+			return applied, errors.WithStack(err)
+		}
+		if version == 0 {
+			break
+		}
+		applied = append(applied, version)
+	}
+	return applied, nil
+}
+
+// MigrateDown rolls back the last [n] applied migrations. It returns the versions that are rolled back.
+func MigrateDown(n int) ([]int, error) {
+	err := prepareMigration()
+	if err != nil {
+		return nil, err
+	}
+
+	var rolledBack []int
+	for len(rolledBack) < n {
+		var version int
+		err = gDB.Transaction(func(tx *gorm.DB) (err error) {
+			version, err = currentVersion(tx)
+			if err != nil || version == 0 {
+				return
+			}
+			if version > len(migrations) {
+				return fmt.Errorf("Unknown migration %d, the database is newer than this program.", version)
+			}
+			m := migrations[version-1]
+			if m.down == nil {
+				return errors.Wrapf(ErrIrreversibleMigration, "migration %d (%s)", m.version, m.name)
+			}
+			err = m.down(tx)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d (%s)", m.version, m.name)
+			}
+			err = tx.Delete(&SchemaMigration{Version: m.version}).Error
+			if err != nil {
+				return
+			}
+			return setDBVersion(tx, m.version-1)
+		})
+		if err != nil {
+			return rolledBack, errors.WithStack(err)
+		}
+		if version == 0 {
+			break
+		}
+		rolledBack = append(rolledBack, version)
+	}
+	return rolledBack, nil
+}
@@ -16,6 +16,13 @@ type SystemSetting struct {
 	Value string
 }
 
+// SchemaMigration records an applied migration, see [migrations]
+type SchemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"type:varchar(100)"`
+	AppliedAt time.Time
+}
+
 type User struct {
 	ID        int64  `gorm:"primary_key;auto_increment:false"` // use snowflake for this ID
 	Email     string `gorm:"type:varchar(255);unique_index"`   // lower case
@@ -55,22 +62,100 @@ type Sentry struct {
 	LastCheckTime  *time.Time
 	NextCheckTime  time.Time `gorm:"index"`
 	Interval       int
+	Schedule       string // json, empty if it is checked every [Interval] minutes since created
+	RequiredTags   string `gorm:"type:varchar(255)"` // tags a worker must have to check it, see [NormalizeTags]
 	CheckCount     int
 	NotifyCount    int
 	LatestImageID  *uint  // foreignkey: SentryImage.ID
 	Task           string // json
 	CreatedAt      time.Time
 	DeletedAt      gorm.DeletedAt `gorm:"index"`
+
+	ConsecutiveFailures int
+	LastError           string
+	LastErrorTime       *time.Time
 }
 
+// SentryImage is a version of the page recorded by a sentry, the text of text sentries is stored the same way.
 type SentryImage struct {
 	ID        uint      `gorm:"primary_key"`
 	SentryID  int64     `gorm:"index:sentryid_createdat"` // foreignkey: Sentry.ID
-	File      string    `gorm:"type:varchar(40)"`
+	File      string    `gorm:"type:varchar(40)"`         // see [utils.ImageGetFullPath] or [utils.TextGetFullPath]
+	DiffFile  string    `gorm:"type:varchar(40)"`         // thumb only, empty for the first image
 	CreatedAt time.Time `gorm:"index:sentryid_createdat"`
 }
 
-// Stored as json string
-type Trigger struct {
-	SimilarityThreshold float64 `json:"similarityThreshold"`
+// Worker is registered by [WorkerInit] and kept alive by fetching tasks
+type Worker struct {
+	ID           string    `gorm:"primaryKey;type:varchar(64)"`
+	Version      string    `gorm:"type:varchar(32)"`
+	Capabilities string    // json
+	Tags         string    // json
+	Protocol     int       // negotiated in [WorkerInit], 0 if it never registered
+	Features     int64     // see [FeatureMask], only meaningful since [ProtocolV2]
+	IP           string    `gorm:"type:varchar(45)"`
+	StartedAt    time.Time // the last time it registered
+	LastSeenAt   time.Time
+	Assigned     int
+	Completed    int
+	Failed       int // including the tasks whose lease expired
+	CreatedAt    time.Time
+}
+
+// WorkerCredential authenticates a worker, its name is used as the ID of the worker
+type WorkerCredential struct {
+	ID        string `gorm:"primaryKey;type:varchar(32)"` // public key ID
+	Name      string `gorm:"type:varchar(64);uniqueIndex"`
+	PublicKey string `gorm:"type:char(64)"` // hex of the ed25519 public key, see [WorkerPublicKey]
+	Scopes    string // json
+	ExpireAt  *time.Time
+	Revoked   bool
+	CreatedAt time.Time
+}
+
+// WorkerSignature is a signature of a worker request seen by any master, so that a request can't be replayed
+type WorkerSignature struct {
+	Signature string    `gorm:"primaryKey;type:char(128)"` // hex
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// RateLimit counts the requests of one key in a window of a rate limit, so that the limit is shared by all masters
+type RateLimit struct {
+	LimitKey    string    `gorm:"primaryKey;type:varchar(128)"`
+	WindowStart time.Time `gorm:"primaryKey;index"`
+	Hits        int64
+}
+
+// Task is a unit of work handed out to workers. Tasks are kept in the database so that they survive restarts
+// of the master, the row is deleted once the task is fully processed.
+type Task struct {
+	ID           int64 `gorm:"primaryKey;autoIncrement:false"` // use snowflake for this ID
+	Mode         TaskMode
+	State        TaskState `gorm:"index"`
+	Priority     int       // higher ones are handed out first
+	Task         string    // json, sent to the worker as it is
+	ExpireAt     time.Time // deadline in the queue, lease while assigned, retention or processing lease once done
+	WorkerID     string    `gorm:"type:varchar(64)"` // the worker it was assigned to last time
+	Attempts     int
+	FeedbackCode int
+	FeedbackMsg  string
+
+	// full screenshot
+	UserID     int64  // foreignkey: User.ID
+	ImageToken string `gorm:"type:varchar(16)"` // tmp token for get request for the actual image
+
+	// sentry
+	SentryID    int64  `gorm:"index"` // foreignkey: Sentry.ID
+	BaseImageID *uint  // foreignkey: SentryImage.ID
+	Trigger     string // json, a copy of Sentry.Trigger at the time it was queued
+	Host        string `gorm:"type:varchar(255);index"` // the host being checked, for politeness limits
+	// a copy of Sentry.RequiredTags, it is not json because it is used in queries
+	RequiredTags     string    `gorm:"type:varchar(255)"`
+	RequiredFeatures int64     // see [TaskSpec.RequiredFeatures]
+	AvailableAt      time.Time // it is not handed out before this time
+	Similarity       *float64  // nil if there wasn't a base image to compare with
+	Changed          bool      // whether a change was recorded
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
@@ -0,0 +1,1472 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"golang.org/x/text/language"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The tests run against an in-memory SQLite database by default. Set WEBSENTRY_TEST_DB_TYPE and
+// WEBSENTRY_TEST_DB (the same as "type" and "dataSourceName" in config) to run them against another
+// database. All existing tables in it will be dropped.
+func openTestDB() (*gorm.DB, error) {
+	dbType := os.Getenv("WEBSENTRY_TEST_DB_TYPE")
+	dsn := os.Getenv("WEBSENTRY_TEST_DB")
+	gormConfig := &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	}
+
+	switch dbType {
+	case "", "sqlite":
+		if dsn == "" {
+			dsn = ":memory:"
+		}
+		db, err := gorm.Open(sqlite.Open(dsn), gormConfig)
+		if err != nil {
+			return nil, err
+		}
+		// an in-memory database only lives in a single connection
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+		return db, nil
+	case "mysql":
+		dsnConfig, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		dsnConfig.ParseTime = true
+		return gorm.Open(mysql.New(mysql.Config{DSNConfig: dsnConfig}), gormConfig)
+	case "postgres":
+		return gorm.Open(postgres.Open(dsn), gormConfig)
+	default:
+		return nil, fmt.Errorf("Unsupported database type: %v", dbType)
+	}
+}
+
+func TestMain(m *testing.M) {
+	db, err := openTestDB()
+	if err != nil {
+		panic(err)
+	}
+
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		panic(err)
+	}
+	for _, table := range tables {
+		err = db.Migrator().DropTable(table)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = Init(db, 1)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func createTestUser(t *testing.T, email string) (userID int64, notificationID int64) {
+	t.Helper()
+	err := Transaction(func(tx TX) (err error) {
+		err = tx.CreateUser(email, "pwd123456", time.UTC, language.AmericanEnglish)
+		if err != nil {
+			return
+		}
+		var result User
+		err = tx.tx.Where(&User{Email: email}).First(&result).Error
+		if err != nil {
+			return
+		}
+		userID = result.ID
+		notifications, err := tx.NotificationList(userID)
+		if err != nil {
+			return
+		}
+		if len(notifications) != 1 {
+			t.Fatalf("expected the default notification, got %d", len(notifications))
+		}
+		notificationID = notifications[0].ID
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func checkMigrationStatus(t *testing.T, expectedVersion int) {
+	t.Helper()
+	status, err := GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("unexpected number of migrations: %d", len(status))
+	}
+	for _, s := range status {
+		if (s.AppliedAt != nil) != (s.Version <= expectedVersion) {
+			t.Errorf("unexpected status of migration %d: %v", s.Version, s.AppliedAt)
+		}
+	}
+
+	var dbVersion SystemSetting
+	err = gDB.Where(&SystemSetting{Key: "db_version"}).First(&dbVersion).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbVersion.Value != strconv.Itoa(expectedVersion) {
+		t.Errorf("unexpected db_version: %v", dbVersion.Value)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	latest := len(migrations)
+	checkMigrationStatus(t, latest)
+
+	applied, err := MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("nothing should be applied: %v", applied)
+	}
+
+	rolledBack, err := MigrateDown(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rolledBack) != 2 || rolledBack[0] != latest {
+		t.Errorf("unexpected rolled back migrations: %v", rolledBack)
+	}
+	checkMigrationStatus(t, latest-2)
+
+	applied, err = MigrateUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0] != latest-1 {
+		t.Errorf("unexpected applied migrations: %v", applied)
+	}
+	_, err = MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMigrationStatus(t, latest)
+
+	// migration 2 can't be rolled back
+	_, err = MigrateDown(latest)
+	if !errors.Is(err, ErrIrreversibleMigration) {
+		t.Errorf("expected ErrIrreversibleMigration, got %v", err)
+	}
+	checkMigrationStatus(t, 2)
+	_, err = MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// databases that only have a "db_version"
+	err = gDB.Where("1 = 1").Delete(&SchemaMigration{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMigrationStatus(t, latest)
+}
+
+func TestUser(t *testing.T) {
+	const email = "user@test.com"
+
+	err := Transaction(func(tx TX) error {
+		code, err := tx.CreateEmailVerification(email)
+		if err != nil {
+			return err
+		}
+		ok, err := tx.CheckVerificationCode(email, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			t.Error("verification code should be valid")
+		}
+		exceeded, err := tx.IsLastVerificationCodeGeneratedTimeExceeded(email)
+		if err != nil {
+			return err
+		}
+		if !exceeded {
+			t.Error("a new verification code should not be allowed yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, _ := createTestUser(t, email)
+
+	err = Transaction(func(tx TX) error {
+		exists, err := tx.CheckUserExistence(email)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			t.Error("user should exist")
+		}
+
+		id, err := tx.UserLogin(email, "pwd123456")
+		if err != nil {
+			return err
+		}
+		if id == nil || *id != userID {
+			t.Errorf("login with the correct password failed")
+		}
+		id, err = tx.UserLogin(email, "wrong-password")
+		if err != nil {
+			return err
+		}
+		if id != nil {
+			t.Errorf("login with a wrong password succeeded")
+		}
+
+		err = tx.UpdateUser(userID, User{TimeZone: "Australia/Melbourne"})
+		if err != nil {
+			return err
+		}
+		u, err := tx.GetUserByID(userID)
+		if err != nil {
+			return err
+		}
+		if u.TimeZone != "Australia/Melbourne" || u.Language != "en-US" {
+			t.Errorf("unexpected user settings: %v %v", u.TimeZone, u.Language)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSentry(t *testing.T) {
+	userID, notificationID := createTestUser(t, "sentry@test.com")
+
+	s := &Sentry{
+		Name:           "test",
+		UserID:         userID,
+		RunningState:   RSRunning,
+		NotificationID: notificationID,
+		Trigger:        `{"similarityThreshold":0.9}`,
+		NextCheckTime:  time.Now(),
+		Interval:       30,
+		Task:           `{"url":"https://example.com"}`,
+	}
+
+	var sid int64
+	err := Transaction(func(tx TX) (err error) {
+		sid, err = tx.CreateSentry(s)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Transaction(func(tx TX) error {
+		_, err := tx.CreateSentry(&Sentry{UserID: userID, NotificationID: 42})
+		if !errors.Is(err, ErrInvalidNotificationID) {
+			t.Errorf("expected ErrInvalidNotificationID, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scheduler picks it up once, then it is delayed
+	err = Transaction(func(tx TX) error {
+		sentry, image, err := tx.GetUncheckedSentry()
+		if err != nil {
+			return err
+		}
+		if sentry == nil || sentry.ID != sid || image != nil {
+			t.Fatalf("unexpected unchecked sentry: %+v %+v", sentry, image)
+		}
+		sentry, _, err = tx.GetUncheckedSentry()
+		if err != nil {
+			return err
+		}
+		if sentry != nil {
+			t.Errorf("sentry should have been delayed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first check
+	err = Transaction(func(tx TX) error {
+		return tx.UpdateSentryAfterCheck(sid, true, false, "image1", "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change detected
+	err = Transaction(func(tx TX) error {
+		return tx.UpdateSentryAfterCheck(sid, true, true, "image2", "diff2")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Transaction(func(tx TX) error {
+		sentry, err := tx.GetSentry(sid)
+		if err != nil {
+			return err
+		}
+		if sentry.CheckCount != 2 || sentry.NotifyCount != 1 || sentry.LastCheckTime == nil {
+			t.Errorf("unexpected sentry after check: %+v", sentry)
+		}
+		if !sentry.NextCheckTime.After(*sentry.LastCheckTime) {
+			t.Errorf("next check time is not in the future: %v", sentry.NextCheckTime)
+		}
+
+		images, err := tx.GetImageHistory(sid)
+		if err != nil {
+			return err
+		}
+		if len(images) != 2 || images[0].ID != *sentry.LatestImageID || images[0].DiffFile != "diff2" {
+			t.Errorf("unexpected image history: %+v", images)
+		}
+
+		// wrong owner
+		err = tx.UpdateSentry(sid, userID+1, &Sentry{Name: "other"})
+		if !IsErrNoDocument(err) {
+			t.Errorf("expected ErrRecordNotFound, got %v", err)
+		}
+
+		err = tx.UpdateSentry(sid, userID, &Sentry{RunningState: RSPaused})
+		if err != nil {
+			return err
+		}
+		err = tx.UpdateSentryAfterCheck(sid, false, false, "", "")
+		if !errors.Is(err, ErrSentryNotRunning) {
+			t.Errorf("expected ErrSentryNotRunning, got %v", err)
+		}
+
+		err = tx.DeleteSentry(sid, userID)
+		if err != nil {
+			return err
+		}
+		sentries, err := tx.GetUserSentries(userID)
+		if err != nil {
+			return err
+		}
+		if len(sentries) != 0 {
+			t.Errorf("sentry was not deleted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTask(t *testing.T) {
+	queueTimeout := func(TaskMode) time.Duration { return time.Minute }
+
+	task := &Task{Mode: TMSentry, Task: "{}", ExpireAt: time.Now().Add(time.Minute), SentryID: 1}
+	err := Transaction(func(tx TX) error {
+		return tx.CreateTask(task)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Transaction(func(tx TX) error {
+		count, err := tx.CountQueuedTasks()
+		if err != nil {
+			return err
+		}
+		if count != 1 {
+			t.Errorf("unexpected number of queued tasks: %d", count)
+		}
+
+		// the lease expires immediately
+		assigned, err := tx.ClaimNextTask("worker1", 0, TaskFilter{})
+		if err != nil {
+			return err
+		}
+		if assigned == nil || assigned.ID != task.ID || assigned.State != TSAssigned || assigned.Attempts != 1 {
+			t.Fatalf("unexpected assigned task: %+v", assigned)
+		}
+		err = tx.FinishTask(task.ID, "worker1", 0, "", "", time.Minute)
+		if !errors.Is(err, ErrTaskNotAssignable) {
+			t.Errorf("the result is submitted after the lease expired: %v", err)
+		}
+		again, err := tx.ClaimNextTask("worker2", time.Minute, TaskFilter{})
+		if err != nil {
+			return err
+		}
+		if again != nil {
+			t.Errorf("a task can only be assigned once")
+		}
+
+		requeued, failed, err := tx.RequeueExpiredTasks(2, queueTimeout)
+		if err != nil {
+			return err
+		}
+		if len(requeued) != 1 || len(failed) != 0 {
+			t.Errorf("unexpected requeued tasks: %+v %+v", requeued, failed)
+		}
+		_, err = tx.ClaimNextTask("worker2", 0, TaskFilter{})
+		if err != nil {
+			return err
+		}
+		requeued, failed, err = tx.RequeueExpiredTasks(2, queueTimeout)
+		if err != nil {
+			return err
+		}
+		if len(requeued) != 0 || len(failed) != 1 {
+			t.Errorf("the task should fail after 2 attempts: %+v %+v", requeued, failed)
+		}
+
+		err = tx.FinishTask(task.ID, "worker2", 0, "", "", time.Minute)
+		if !errors.Is(err, ErrTaskNotAssignable) {
+			t.Errorf("expected ErrTaskNotAssignable, got %v", err)
+		}
+		unprocessed, err := tx.GetUnprocessedSentryTasks()
+		if err != nil {
+			return err
+		}
+		if len(unprocessed) != 1 {
+			t.Errorf("unexpected unprocessed tasks: %+v", unprocessed)
+		}
+		claimed, err := tx.ClaimTaskResult(task.ID, time.Minute)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			t.Errorf("failed to claim the result")
+		}
+		claimed, err = tx.ClaimTaskResult(task.ID, time.Minute)
+		if err != nil {
+			return err
+		}
+		if claimed {
+			t.Errorf("a result can only be claimed once")
+		}
+		return tx.DeleteTask(task.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskHostLimit(t *testing.T) {
+	now := time.Now()
+	tasks := []*Task{
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), Host: "a.example.com", CreatedAt: now.Add(-3 * time.Second)},
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), Host: "a.example.com", CreatedAt: now.Add(-2 * time.Second)},
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), Host: "b.example.com", CreatedAt: now.Add(-time.Second)},
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), Host: "c.example.com", AvailableAt: now.Add(time.Minute)},
+	}
+	err := Transaction(func(tx TX) error {
+		for _, task := range tasks {
+			err := tx.CreateTask(task)
+			if err != nil {
+				return err
+			}
+		}
+
+		last, err := tx.LastHostTaskTime("c.example.com")
+		if err != nil {
+			return err
+		}
+		if !last.Equal(tasks[3].AvailableAt) {
+			t.Errorf("unexpected last task time: %v", last)
+		}
+
+		// the second task of a.example.com waits until the first one is done
+		for _, expected := range []*Task{tasks[0], tasks[2], nil} {
+			assigned, err := tx.ClaimNextTask("worker1", time.Minute, TaskFilter{HostConcurrency: 1})
+			if err != nil {
+				return err
+			}
+			if (assigned == nil) != (expected == nil) || (assigned != nil && assigned.ID != expected.ID) {
+				t.Errorf("unexpected assigned task: %+v", assigned)
+			}
+		}
+
+		for _, task := range tasks {
+			err = tx.DeleteTask(task.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskTags(t *testing.T) {
+	tags, err := ParseTags(" Region=EU,mobile,,region=eu ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NormalizeTags(tags) != "mobile,region=eu" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	for _, s := range []string{"a b", "=eu", "a=b=c"} {
+		if _, err := ParseTags(s); !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+
+	now := time.Now()
+	tasks := []*Task{
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), RequiredTags: "mobile,region=eu", CreatedAt: now.Add(-3 * time.Second)},
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), RequiredTags: "region=us", CreatedAt: now.Add(-2 * time.Second)},
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), CreatedAt: now.Add(-time.Second)},
+	}
+	err = Transaction(func(tx TX) error {
+		for _, task := range tasks {
+			err := tx.CreateTask(task)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the older tagged tasks don't hold back the untagged one
+		claims := []struct {
+			tags     []string
+			expected *Task
+		}{
+			{[]string{"region=eu"}, tasks[2]},
+			{[]string{"region=eu"}, nil},
+			{[]string{"mobile", "region=eu", "region=us"}, tasks[0]},
+			{nil, nil},
+			{[]string{"region=us"}, tasks[1]},
+		}
+		for _, claim := range claims {
+			assigned, err := tx.ClaimNextTask("worker1", time.Minute, TaskFilter{Tags: claim.tags})
+			if err != nil {
+				return err
+			}
+			if (assigned == nil) != (claim.expected == nil) || (assigned != nil && assigned.ID != claim.expected.ID) {
+				t.Errorf("unexpected assigned task for %v: %+v", claim.tags, assigned)
+			}
+		}
+
+		_, err = tx.ClaimNextTask("worker1", time.Minute, TaskFilter{Tags: make([]string, MaxWorkerTags+1)})
+		if !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("too many tags should be rejected: %v", err)
+		}
+
+		for _, task := range tasks {
+			err = tx.DeleteTask(task.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskCancel(t *testing.T) {
+	now := time.Now()
+	tasks := []*Task{
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), SentryID: 56789, CreatedAt: now.Add(-time.Second)},
+		{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), SentryID: 56789},
+	}
+	err := Transaction(func(tx TX) error {
+		for _, task := range tasks {
+			err := tx.CreateTask(task)
+			if err != nil {
+				return err
+			}
+		}
+
+		assigned, err := tx.ClaimNextTask("worker1", time.Second, TaskFilter{})
+		if err != nil {
+			return err
+		}
+		if assigned == nil || assigned.ID != tasks[0].ID {
+			t.Fatalf("unexpected assigned task: %+v", assigned)
+		}
+
+		cancelled, err := tx.ExtendTaskLease(assigned.ID, "worker1", time.Hour)
+		if err != nil || cancelled {
+			t.Errorf("failed to extend the lease: %v %v", cancelled, err)
+		}
+		task, err := tx.GetTask(assigned.ID)
+		if err != nil {
+			return err
+		}
+		if task.ExpireAt.Before(now.Add(time.Minute)) {
+			t.Errorf("lease is not extended: %v", task.ExpireAt)
+		}
+		_, err = tx.ExtendTaskLease(assigned.ID, "worker2", time.Hour)
+		if !errors.Is(err, ErrTaskNotAssignable) {
+			t.Errorf("others can't extend the lease: %v", err)
+		}
+
+		err = tx.CancelSentryTasks(56789)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			task, err := tx.GetTask(task.ID)
+			if err != nil {
+				return err
+			}
+			if task.State != TSCancelled {
+				t.Errorf("task is not cancelled: %+v", task)
+			}
+		}
+		cancelled, err = tx.ExtendTaskLease(assigned.ID, "worker1", time.Hour)
+		if err != nil || !cancelled {
+			t.Errorf("worker is not told about the cancellation: %v %v", cancelled, err)
+		}
+		err = tx.FinishTask(assigned.ID, "worker1", 0, "", "", 0)
+		if !errors.Is(err, ErrTaskNotAssignable) {
+			t.Errorf("cancelled task is finished: %v", err)
+		}
+		next, err := tx.ClaimNextTask("worker1", time.Minute, TaskFilter{})
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			t.Errorf("cancelled task is assigned: %+v", next)
+		}
+
+		for _, task := range tasks {
+			err = tx.DeleteTask(task.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskSpec(t *testing.T) {
+	// stored before the schema was versioned
+	legacy := `{"url":"https://Example.com/a","timeout":40000,"fullPage":false,"clip":{"x":1,"width":20,"height":30,"y":2},` +
+		`"viewport":{"width":900,"isMobile":false},"output":{"type":"png"}}`
+	spec, err := ParseTaskSpec(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Schema != 1 || spec.Clip == nil || *spec.Clip != (Rect{1, 2, 20, 30}) || spec.Host() != "example.com" {
+		t.Errorf("unexpected task: %+v", spec)
+	}
+	if spec.RequiredFeatures() != FeatureMask([]string{FeatureScreenshot, FeatureClip, FeaturePNG}) {
+		t.Errorf("unexpected features: %v", FeatureNames(spec.RequiredFeatures()))
+	}
+	for _, invalid := range []string{
+		`{"schema":99,"url":"https://example.com","timeout":1,"viewport":{"width":1},"output":{"type":"png"}}`,
+		`{"url":"ftp://example.com","timeout":1,"viewport":{"width":1},"output":{"type":"png"}}`,
+		`{"url":"https://example.com","timeout":1,"viewport":{"width":1},"output":{"type":"gif"}}`,
+		`{"type":"text","url":"https://example.com","timeout":1,"viewport":{"width":1},"extract":"text"}`,
+		`{"type":"text","url":"https://example.com","timeout":1,"viewport":{"width":1},"selector":"p","extract":"css"}`,
+		`{"type":"pdf","url":"https://example.com","timeout":1,"viewport":{"width":1},"output":{"type":"png"}}`,
+	} {
+		if _, err := ParseTaskSpec(invalid); !errors.Is(err, ErrInvalidTaskSpec) {
+			t.Errorf("%s should be invalid: %v", invalid, err)
+		}
+	}
+	text, err := ParseTaskSpec(`{"type":"text","url":"https://example.com","timeout":1,"viewport":{"width":1},` +
+		`"selector":"#news li","extract":"html"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text.RequiredFeatures() != FeatureMask([]string{FeatureText}) {
+		t.Errorf("unexpected features: %v", FeatureNames(text.RequiredFeatures()))
+	}
+	if (&Trigger{Masks: []Rect{{0, 0, 1, 1}}}).ValidateTask(text) == nil {
+		t.Error("a text task can't have masks")
+	}
+
+	now := time.Now()
+	task := &Task{Mode: TMSentry, Task: legacy, ExpireAt: now.Add(time.Minute), RequiredFeatures: spec.RequiredFeatures()}
+	err = Transaction(func(tx TX) error {
+		err := tx.CreateTask(task)
+		if err != nil {
+			return err
+		}
+
+		w := &Worker{ID: "worker-features", Protocol: ProtocolV2, Features: FeatureMask([]string{FeatureScreenshot, FeaturePNG})}
+		for _, features := range []int64{w.FeatureSet(), (&Worker{Protocol: ProtocolV1}).FeatureSet()} {
+			assigned, err := tx.ClaimNextTask(w.ID, time.Minute, TaskFilter{Features: features})
+			if err != nil {
+				return err
+			}
+			if (assigned != nil) != (features == LegacyFeatures) {
+				t.Errorf("unexpected assigned task for %v: %+v", FeatureNames(features), assigned)
+			}
+		}
+		return tx.DeleteTask(task.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	regions := []Region{
+		{Name: "title", Rect: Rect{X: 10, Y: 20, Width: 100, Height: 30}},
+		{Name: "price", Rect: Rect{X: 200, Y: 100, Width: 50, Height: 20}},
+	}
+	task := &TaskSpec{Schema: TaskSchema, URL: "https://example.com", Timeout: 1, Viewport: Viewport{Width: 900},
+		Output: TaskOutput{Type: "png"}, Clip: RegionsClip(regions), Regions: regions}
+	if *task.Clip != (Rect{10, 20, 240, 100}) || task.Validate() != nil {
+		t.Errorf("unexpected task: %+v", task)
+	}
+	if r := task.RegionRectangle(regions[1]); r != image.Rect(190, 80, 240, 100) {
+		t.Errorf("unexpected region rectangle: %v", r)
+	}
+	for _, invalid := range [][]Region{
+		{regions[0], {Name: "title", Rect: Rect{X: 10, Y: 20, Width: 1, Height: 1}}},
+		{regions[0], {Name: "", Rect: Rect{X: 10, Y: 20, Width: 1, Height: 1}}},
+		{regions[0], {Name: "outside", Rect: Rect{X: 0, Y: 0, Width: 10, Height: 10}}},
+		{regions[0], {Name: "huge", Rect: Rect{X: 10, Y: 20, Width: math.MaxInt, Height: 1}}},
+		{regions[0], {Name: "far", Rect: Rect{X: math.MaxInt, Y: 20, Width: math.MaxInt, Height: 1}}},
+	} {
+		invalidTask := *task
+		invalidTask.Regions = invalid
+		if err := invalidTask.Validate(); !errors.Is(err, ErrInvalidTaskSpec) {
+			t.Errorf("%+v should be invalid: %v", invalid, err)
+		}
+	}
+
+	trigger, err := ParseTrigger(`{"similarityThreshold":0.99,"masks":[{"x":0,"y":0,"width":200,"height":90}],` +
+		`"regionThresholds":{"price":{"similarityThreshold":0.5}}}`)
+	if err != nil || trigger.ValidateTask(task) != nil {
+		t.Fatal(err)
+	}
+	title := trigger.ForRegion(task, regions[0])
+	if title.SimilarityThreshold != 0.99 || len(title.Masks) != 1 || title.Masks[0] != (Rect{0, 0, 100, 30}) {
+		t.Errorf("unexpected trigger: %+v", title)
+	}
+	price := trigger.ForRegion(task, regions[1])
+	if price.SimilarityThreshold != 0.5 || len(price.Masks) != 1 || price.Masks[0] != (Rect{0, 0, 10, 10}) {
+		t.Errorf("unexpected trigger: %+v", price)
+	}
+	if trigger.SimilarityThreshold != 0.99 || len(trigger.Masks) != 1 {
+		t.Errorf("the trigger is modified: %+v", trigger)
+	}
+
+	for _, invalid := range []string{
+		`{"similarityThreshold":0.99,"regionThresholds":{"price":{"similarityThreshold":2}}}`,
+		`{"algorithm":"dHash","similarityThreshold":0.99,"regionThresholds":{"price":{"hashDistance":-1}}}`,
+	} {
+		if _, err := ParseTrigger(invalid); !errors.Is(err, ErrInvalidTrigger) {
+			t.Errorf("%s should be invalid: %v", invalid, err)
+		}
+	}
+	trigger.RegionThresholds["footer"] = RegionThreshold{}
+	if trigger.ValidateTask(task) == nil {
+		t.Error("unknown regions should be invalid")
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	// stored before the algorithm was configurable
+	trigger, err := ParseTrigger(`{"similarityThreshold":0.99}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trigger.GetAlgorithm() != AlgorithmMeanDifference || trigger.SimilarityThreshold != 0.99 {
+		t.Errorf("unexpected trigger: %+v", trigger)
+	}
+
+	// switching keeps the threshold of the previous algorithm
+	trigger.SetAlgorithm(AlgorithmDHash)
+	if trigger.HashDistance != DefaultHashDistance || trigger.SimilarityThreshold != 0.99 || trigger.Validate() != nil {
+		t.Errorf("unexpected trigger: %+v", trigger)
+	}
+	trigger.SetAlgorithm(AlgorithmSSIM)
+	if trigger.SSIMThreshold != DefaultSSIMThreshold || trigger.Validate() != nil {
+		t.Errorf("unexpected trigger: %+v", trigger)
+	}
+
+	for _, invalid := range []string{
+		`{"similarityThreshold":0}`,
+		`{"algorithm":"ssim","similarityThreshold":0.9}`,
+		`{"algorithm":"dHash","similarityThreshold":0.9,"hashDistance":64}`,
+		`{"algorithm":"pixels","similarityThreshold":0.9}`,
+		`{"similarityThreshold":0.9,"sizePolicy":"crop"}`,
+		`{"similarityThreshold":0.9,"masks":[{"x":0,"y":0,"width":0,"height":10}]}`,
+		`{"similarityThreshold":0.9,"conditions":[{"type":"keywordAppears"}]}`,
+		`{"similarityThreshold":0.9,"conditions":[{"type":"regexMatches","pattern":"("}]}`,
+		`{"similarityThreshold":0.9,"conditions":[{"type":"lengthAbove","value":1}]}`,
+		`{"similarityThreshold":0.9,"combine":"xor"}`,
+	} {
+		if _, err := ParseTrigger(invalid); !errors.Is(err, ErrInvalidTrigger) {
+			t.Errorf("%s should be invalid: %v", invalid, err)
+		}
+	}
+
+	task := &TaskSpec{Clip: &Rect{X: 100, Y: 100, Width: 50, Height: 40}, Viewport: Viewport{Width: 900}}
+	for _, c := range []struct {
+		mask  Rect
+		valid bool
+	}{
+		{Rect{0, 0, 50, 40}, true},
+		{Rect{10, 10, 41, 10}, false},
+		{Rect{10, 31, 10, 10}, false},
+		// relative to the clip
+		{Rect{100, 100, 10, 10}, false},
+		{Rect{10, 10, math.MaxInt, 10}, false},
+		{Rect{math.MaxInt, 10, math.MaxInt, 10}, false},
+		{Rect{10, math.MaxInt, 10, math.MaxInt}, false},
+	} {
+		trigger := &Trigger{SimilarityThreshold: 0.9, Masks: []Rect{c.mask}}
+		if err := trigger.ValidateTask(task); (err == nil) != c.valid {
+			t.Errorf("unexpected validation of %+v: %v", c.mask, err)
+		}
+	}
+}
+
+func TestConditions(t *testing.T) {
+	text := "Release v1.2.3\nPrice: $1,299.50\nIn stock: 12"
+	for _, c := range []struct {
+		condition Condition
+		met       bool
+		value     string
+	}{
+		{Condition{Type: ConditionKeywordAppears, Keyword: "In stock"}, true, "In stock"},
+		{Condition{Type: ConditionKeywordAppears, Keyword: "in stock"}, false, ""},
+		{Condition{Type: ConditionKeywordDisappears, Keyword: "Sold out"}, true, ""},
+		{Condition{Type: ConditionRegexMatches, Pattern: `v\d+\.\d+\.\d+`}, true, "v1.2.3"},
+		{Condition{Type: ConditionRegexMatches, Pattern: `v2\.`}, false, ""},
+		// the first number of the text
+		{Condition{Type: ConditionNumberBelow, Value: 2}, true, "1.2"},
+		{Condition{Type: ConditionNumberBelow, Pattern: `Price: \$(\S+)`, Value: 1300}, true, "1,299.50"},
+		{Condition{Type: ConditionNumberAbove, Pattern: `Price: \$(\S+)`, Value: 1300}, false, "1,299.50"},
+		{Condition{Type: ConditionNumberAbove, Pattern: `In stock: \d+`, Value: 10}, false, "In stock: 12"},
+		{Condition{Type: ConditionNumberAbove, Pattern: `Weight: (\d+)`, Value: 10}, false, ""},
+	} {
+		if err := c.condition.Validate(); err != nil {
+			t.Errorf("%v: %v", c.condition.String(), err)
+		}
+		met, value, err := c.condition.Evaluate(text)
+		if err != nil || met != c.met || value != c.value {
+			t.Errorf("unexpected result of %v: %v %q %v", c.condition.String(), met, value, err)
+		}
+	}
+	// the pattern is compiled by the validation
+	unvalidated := Condition{Type: ConditionRegexMatches, Pattern: "v1"}
+	if _, _, err := unvalidated.Evaluate(text); err == nil {
+		t.Error("an unvalidated condition is evaluated")
+	}
+
+	trigger := &Trigger{SimilarityThreshold: 0.9, Conditions: []Condition{
+		{Type: ConditionKeywordAppears, Keyword: "Sold out"},
+		{Type: ConditionNumberAbove, Pattern: `In stock: (\d+)`, Value: 10},
+	}}
+	if err := trigger.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, combine := range []string{"", CombineAll, CombineAny} {
+		trigger.Combine = combine
+		met, results, err := trigger.EvaluateConditions(text)
+		if err != nil || met != (combine == CombineAny) || len(results) != 2 || results[0].Met || !results[1].Met {
+			t.Errorf("unexpected result of %q: %v %+v", combine, met, results)
+		}
+	}
+
+	image := &TaskSpec{Clip: &Rect{X: 0, Y: 0, Width: 50, Height: 40}, Viewport: Viewport{Width: 900}}
+	if trigger.ValidateTask(image) == nil {
+		t.Error("an image task can't have conditions")
+	}
+}
+
+// TestSkipLocked checks that rows locked by another master are skipped instead of waiting for them, SQLite locks
+// the whole database instead.
+func TestSkipLocked(t *testing.T) {
+	if gDB.Dialector.Name() == "sqlite" {
+		t.Skip("SQLite doesn't lock rows")
+	}
+	userID, notificationID := createTestUser(t, "locked@test.com")
+	now := time.Now()
+	var tasks []int64
+	var sentries []int64
+	err := Transaction(func(tx TX) error {
+		for i := 0; i < 2; i++ {
+			// ahead of the others
+			task := &Task{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), SentryID: int64(56780 + i),
+				AvailableAt: now, Priority: 100}
+			err := tx.CreateTask(task)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, task.ID)
+			id, err := tx.CreateSentry(&Sentry{Name: "locked", UserID: userID, NotificationID: notificationID,
+				RunningState: RSRunning, Trigger: `{"similarityThreshold":0.9}`, Interval: 30,
+				NextCheckTime: now.AddDate(-10, 0, i), Task: `{"url":"https://example.com"}`})
+			if err != nil {
+				return err
+			}
+			sentries = append(sentries, id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		gDB.Delete(&Task{}, tasks)
+		gDB.Delete(&Sentry{}, sentries)
+	}()
+
+	// another master holds the first ones
+	held := gDB.Begin()
+	defer held.Rollback()
+	task, err := TX{tx: held}.ClaimNextTask("worker-held", time.Minute, TaskFilter{})
+	if err != nil || task == nil || task.ID != tasks[0] {
+		t.Fatalf("unexpected task: %+v %v", task, err)
+	}
+	sentry, _, err := TX{tx: held}.GetUncheckedSentry()
+	if err != nil || sentry == nil || sentry.ID != sentries[0] {
+		t.Fatalf("unexpected sentry: %+v %v", sentry, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- Transaction(func(tx TX) error {
+			task, err := tx.ClaimNextTask("worker-other", time.Minute, TaskFilter{})
+			if err != nil {
+				return err
+			}
+			if task == nil || task.ID != tasks[1] {
+				return fmt.Errorf("unexpected task: %+v", task)
+			}
+			sentry, _, err := tx.GetUncheckedSentry()
+			if err != nil {
+				return err
+			}
+			if sentry == nil || sentry.ID != sentries[1] {
+				return fmt.Errorf("unexpected sentry: %+v", sentry)
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiting for the locked rows")
+	}
+}
+
+func TestRequestedSentryTask(t *testing.T) {
+	now := time.Now()
+	task := &Task{Mode: TMSentry, Task: "{}", ExpireAt: now.Add(time.Minute), SentryID: 45678,
+		AvailableAt: now.Add(time.Hour)}
+	err := Transaction(func(tx TX) error {
+		err := tx.CreateTask(task)
+		if err != nil {
+			return err
+		}
+
+		active, err := tx.GetActiveSentryTask(task.SentryID)
+		if err != nil {
+			return err
+		}
+		if active == nil || active.ID != task.ID {
+			t.Fatalf("unexpected active task: %+v", active)
+		}
+		err = tx.PrioritizeTask(task.ID, 1, 42)
+		if err != nil {
+			return err
+		}
+		assigned, err := tx.ClaimNextTask("worker1", time.Minute, TaskFilter{})
+		if err != nil {
+			return err
+		}
+		if assigned == nil || assigned.ID != task.ID || assigned.Priority != 1 || assigned.UserID != 42 {
+			t.Fatalf("unexpected assigned task: %+v", assigned)
+		}
+
+		err = tx.FinishTask(task.ID, "worker2", 0, "", "", 0)
+		if !errors.Is(err, ErrTaskNotAssignable) {
+			t.Errorf("the task is assigned to another worker: %v", err)
+		}
+		err = tx.FinishTask(task.ID, "worker1", 0, "", "", 0)
+		if err != nil {
+			return err
+		}
+		err = tx.FinishTask(task.ID, "worker1", 0, "", "", 0)
+		if !errors.Is(err, ErrTaskNotAssignable) {
+			t.Errorf("the result is submitted twice: %v", err)
+		}
+		similarity := 0.5
+		err = tx.FinishSentryTaskProcessing(task.ID, &similarity, true, "", 0)
+		if err != nil {
+			return err
+		}
+		task, err = tx.GetTask(task.ID)
+		if err != nil {
+			return err
+		}
+		if task.State != TSProcessed || task.Similarity == nil || *task.Similarity != 0.5 || !task.Changed {
+			t.Errorf("unexpected processed task: %+v", task)
+		}
+		active, err = tx.GetActiveSentryTask(task.SentryID)
+		if err != nil {
+			return err
+		}
+		if active != nil {
+			t.Errorf("the task is not active anymore: %+v", active)
+		}
+
+		ids, err := tx.DeleteStaleTasks()
+		if err != nil {
+			return err
+		}
+		if len(ids) != 1 || ids[0] != task.ID {
+			t.Errorf("unexpected deleted tasks: %v", ids)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckJitter(t *testing.T) {
+	defer SetMaxCheckJitter(0)
+	SetMaxCheckJitter(5 * time.Minute)
+
+	s := &Sentry{ID: 34567, Interval: 15}
+	jitter := checkJitter(s)
+	if jitter != checkJitter(s) || jitter < 0 || jitter >= 15*time.Minute/4 {
+		t.Errorf("unexpected jitter: %v", jitter)
+	}
+
+	// the interval between two checks is kept
+	s.CreatedAt = time.Now()
+	err := Transaction(func(tx TX) error {
+		next, err := tx.nextCheckTime(s, s.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if !next.Equal(s.CreatedAt.Add(jitter)) && !next.Equal(s.CreatedAt.Add(15*time.Minute+jitter)) {
+			t.Errorf("unexpected next check time: %v", next.Sub(s.CreatedAt))
+		}
+		after, err := tx.nextCheckTime(s, next)
+		if err != nil {
+			return err
+		}
+		if after.Sub(next) != 15*time.Minute {
+			t.Errorf("unexpected interval: %v", after.Sub(next))
+		}
+
+		// scheduled checks are not shifted, the owner doesn't exist so the time zone is UTC
+		s.UserID = 987654
+		s.Schedule = `{"windowStart":"09:00","windowEnd":"10:00"}`
+		day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+		next, err = tx.nextCheckTime(s, day.Add(9*time.Hour+50*time.Minute))
+		if err != nil {
+			return err
+		}
+		if !next.Equal(day.Add(33 * time.Hour)) {
+			t.Errorf("unexpected scheduled check time: %v", next)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSentryFailure(t *testing.T) {
+	s := &Sentry{ID: 12345, RunningState: RSRunning, Interval: 30, NextCheckTime: time.Now()}
+	err := gDB.Create(s).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a check queued in the meantime
+	task := &Task{Mode: TMSentry, Task: "{}", ExpireAt: time.Now().Add(time.Hour), SentryID: s.ID,
+		AvailableAt: time.Now().Add(time.Hour)}
+	err = Transaction(func(tx TX) error {
+		return tx.CreateTask(task)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gDB.Delete(task)
+
+	for i := 1; i <= MaxConsecutiveFailures; i++ {
+		var paused bool
+		before := time.Now()
+		err = Transaction(func(tx TX) (err error) {
+			paused, err = tx.UpdateSentryAfterFailure(s.ID, "timeout")
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paused != (i == MaxConsecutiveFailures) {
+			t.Errorf("unexpected paused state after %d failures", i)
+		}
+
+		err = Transaction(func(tx TX) (err error) {
+			s, err = tx.GetSentry(s.ID)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ConsecutiveFailures != i || s.LastError != "timeout" {
+			t.Errorf("unexpected sentry after %d failures: %+v", i, s)
+		}
+		delay := s.NextCheckTime.Sub(before)
+		expected := minDuration(retryBaseDelay<<(i-1), 30*time.Minute)
+		if delay < expected || delay > expected+time.Minute {
+			t.Errorf("unexpected delay after %d failures: %v", i, delay)
+		}
+	}
+	if s.RunningState != RSError {
+		t.Errorf("sentry should be in error state: %v", s.RunningState)
+	}
+	err = gDB.First(task, task.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.State != TSCancelled {
+		t.Errorf("the queued task is not cancelled: %v", task.State)
+	}
+
+	err = Transaction(func(tx TX) error {
+		return tx.UpdateSentry(s.ID, 0, &Sentry{RunningState: RSRunning})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Transaction(func(tx TX) error {
+		err := tx.UpdateSentryAfterCheck(s.ID, false, false, "", "")
+		if err != nil {
+			return err
+		}
+		s, err = tx.GetSentry(s.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.RunningState != RSRunning || s.ConsecutiveFailures != 0 {
+		t.Errorf("unexpected sentry after resuming: %+v", s)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []Schedule{
+		{Cron: "*/5 * * * *"},
+		{Cron: "0 7 * * *", WindowStart: "09:00"},
+		{Cron: "TZ=UTC 0 7 * * *"},
+		{WindowStart: "18:00", WindowEnd: "09:00"},
+		{WindowStart: "9am"},
+		{Weekdays: []int{7}},
+	}
+	for _, s := range invalid {
+		if s.Validate() == nil {
+			t.Errorf("schedule should be invalid: %+v", s)
+		}
+	}
+
+	// 2020-06-05 is a Friday
+	cases := []struct {
+		schedule Schedule
+		after    string
+		next     string
+	}{
+		{Schedule{Cron: "0 7 * * *"}, "2020-06-05 06:59", "2020-06-05 07:00"},
+		{Schedule{Cron: "0 7 * * *"}, "2020-06-05 07:00", "2020-06-06 07:00"},
+		{Schedule{WindowStart: "09:00", WindowEnd: "18:00", Weekdays: []int{1, 2, 3, 4, 5}}, "2020-06-05 08:00", "2020-06-05 09:00"},
+		{Schedule{WindowStart: "09:00", WindowEnd: "18:00", Weekdays: []int{1, 2, 3, 4, 5}}, "2020-06-05 09:10", "2020-06-05 09:30"},
+		{Schedule{WindowStart: "09:00", WindowEnd: "18:00", Weekdays: []int{1, 2, 3, 4, 5}}, "2020-06-05 17:30", "2020-06-08 09:00"},
+		{Schedule{WindowStart: "22:00"}, "2020-06-05 23:45", "2020-06-06 22:00"},
+	}
+	for _, c := range cases {
+		err = c.schedule.Validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, _ := time.ParseInLocation("2006-01-02 15:04", c.after, loc)
+		expected, _ := time.ParseInLocation("2006-01-02 15:04", c.next, loc)
+		next := c.schedule.Next(after, 30, loc)
+		if !next.Equal(expected) {
+			t.Errorf("unexpected next check time of %+v after %v: %v", c.schedule, c.after, next)
+		}
+	}
+
+	// it is evaluated in the time zone of the owner
+	userID, _ := createTestUser(t, "schedule@example.com")
+	err = Transaction(func(tx TX) error {
+		return tx.UpdateUser(userID, User{TimeZone: "Asia/Shanghai"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sentry{ID: 23456, UserID: userID, RunningState: RSRunning, Interval: 30, NextCheckTime: time.Now(),
+		Schedule: `{"cron":"0 7 * * *"}`}
+	err = gDB.Create(s).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Transaction(func(tx TX) error {
+		err := tx.UpdateSentryAfterCheck(s.ID, false, false, "", "")
+		if err != nil {
+			return err
+		}
+		s, err = tx.GetSentry(s.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := s.NextCheckTime.In(loc)
+	if next.Hour() != 7 || next.Minute() != 0 || next.Sub(time.Now()) > 24*time.Hour {
+		t.Errorf("unexpected next check time: %v", next)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	err := Transaction(func(tx TX) error {
+		// an older worker without registration
+		err := tx.WorkerHeartbeat("10.0.0.1", "10.0.0.1")
+		if err != nil {
+			return err
+		}
+		err = tx.RegisterWorker(&Worker{ID: "worker-a", Version: "1.0.0", Capabilities: `["png"]`, IP: "10.0.0.2"})
+		if err != nil {
+			return err
+		}
+		err = tx.AddWorkerStats("worker-a", 2, 1, 1)
+		if err != nil {
+			return err
+		}
+		// registering again keeps the statistics
+		err = tx.RegisterWorker(&Worker{ID: "worker-a", Version: "1.1.0", Capabilities: `["png"]`, IP: "10.0.0.2"})
+		if err != nil {
+			return err
+		}
+		// a heartbeat changing nothing, e.g. twice in the same second, updates the same row
+		for i := 0; i < 2; i++ {
+			err = tx.WorkerHeartbeat("worker-a", "10.0.0.3")
+			if err != nil {
+				return err
+			}
+		}
+
+		workers, err := tx.GetWorkers()
+		if err != nil {
+			return err
+		}
+		if len(workers) != 2 {
+			t.Fatalf("unexpected workers: %+v", workers)
+		}
+		w := workers[0]
+		if w.ID != "worker-a" || w.Version != "1.1.0" || w.IP != "10.0.0.3" || w.Assigned != 2 || w.Completed != 1 ||
+			w.Failed != 1 {
+			t.Errorf("unexpected worker: %+v", w)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerCredential(t *testing.T) {
+	secret := strings.Repeat("ab", 32)
+	publicKey, err := WorkerPublicKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{"", "secret", strings.Repeat("ab", 31)} {
+		if _, err := WorkerPublicKey(invalid); !errors.Is(err, ErrInvalidWorkerSecret) {
+			t.Errorf("%q should be invalid: %v", invalid, err)
+		}
+	}
+
+	err = Transaction(func(tx TX) error {
+		err := tx.CreateWorkerCredential(&WorkerCredential{ID: "0123456789abcdef", Name: "worker-b",
+			PublicKey: publicKey, Scopes: `["sentry"]`})
+		if err != nil {
+			return err
+		}
+		// revoking again is fine
+		for i := 0; i < 2; i++ {
+			err = tx.RevokeWorkerCredential("worker-b")
+			if err != nil {
+				return err
+			}
+		}
+		c, err := tx.GetWorkerCredential("0123456789abcdef")
+		if err != nil {
+			return err
+		}
+		if !c.Revoked || c.PublicKey != publicKey {
+			t.Errorf("unexpected credential: %+v", c)
+		}
+
+		// the stored public key verifies the signatures but doesn't sign them
+		key, err := WorkerSigningKey(secret)
+		if err != nil {
+			return err
+		}
+		message := WorkerSignedMessage("POST", "/v1/worker/init", "1600000000", []byte("body"))
+		if !c.VerifyWorkerSignature(message, ed25519.Sign(key, message)) ||
+			c.VerifyWorkerSignature(message[1:], ed25519.Sign(key, message)) {
+			t.Error("unexpected verification")
+		}
+
+		_, err = tx.GetWorkerCredential("")
+		if !IsErrNoDocument(err) {
+			t.Errorf("expected not found, got %v", err)
+		}
+		err = tx.RevokeWorkerCredential("nobody")
+		if !IsErrNoDocument(err) {
+			t.Errorf("expected not found, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerSignature(t *testing.T) {
+	err := Transaction(func(tx TX) error {
+		for i, expected := range []bool{true, false} {
+			unused, err := tx.UseWorkerSignature("aa01")
+			if err != nil {
+				return err
+			}
+			if unused != expected {
+				t.Errorf("unexpected result of use %d: %v", i, unused)
+			}
+		}
+		err := tx.DeleteWorkerSignatures(time.Now().Add(time.Minute))
+		if err != nil {
+			return err
+		}
+		unused, err := tx.UseWorkerSignature("aa01")
+		if err != nil || !unused {
+			t.Errorf("the signature should be deleted: %v", err)
+		}
+		return tx.DeleteWorkerSignatures(time.Now().Add(time.Minute))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	window := time.Now().Truncate(time.Hour)
+	err := Transaction(func(tx TX) error {
+		for i := int64(1); i <= 3; i++ {
+			hits, err := tx.IncrementRateLimit("test:1", window)
+			if err != nil {
+				return err
+			}
+			if hits != i {
+				t.Errorf("unexpected hits: %d, expected %d", hits, i)
+			}
+		}
+		// other keys and windows are counted separately
+		hits, err := tx.IncrementRateLimit("test:2", window)
+		if err != nil || hits != 1 {
+			t.Errorf("unexpected hits of another key: %d %v", hits, err)
+		}
+		hits, err = tx.IncrementRateLimit("test:1", window.Add(time.Hour))
+		if err != nil || hits != 1 {
+			t.Errorf("unexpected hits of another window: %d %v", hits, err)
+		}
+
+		err = tx.ResetRateLimit("test:1", window)
+		if err != nil {
+			return err
+		}
+		hits, err = tx.GetRateLimit("test:1", window)
+		if err != nil || hits != 0 {
+			t.Errorf("the window should be reset: %d %v", hits, err)
+		}
+
+		err = tx.DeleteRateLimits(window.Add(time.Hour))
+		if err != nil {
+			return err
+		}
+		hits, err = tx.GetRateLimit("test:2", window)
+		if err != nil || hits != 0 {
+			t.Errorf("the window should be deleted: %d %v", hits, err)
+		}
+		hits, err = tx.GetRateLimit("test:1", window.Add(time.Hour))
+		if err != nil || hits != 1 {
+			t.Errorf("the next window should be kept: %d %v", hits, err)
+		}
+		return tx.DeleteRateLimits(window.Add(2 * time.Hour))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskID(t *testing.T) {
+	n := &taskIDNode{node: 1023}
+	seen := make(map[int64]bool)
+	last := int64(0)
+	// more IDs than the sequence of a millisecond holds
+	for i := 0; i < 10000; i++ {
+		id := n.generate()
+		if id <= last || id > MaxSafeTaskID || seen[id] {
+			t.Fatalf("unexpected ID %d after %d", id, last)
+		}
+		if node := id >> taskIDStepBits & (1<<taskIDNodeBits - 1); node != 1023 {
+			t.Fatalf("unexpected node of %d: %d", id, node)
+		}
+		seen[id] = true
+		last = id
+	}
+
+	// the clock goes back
+	n.time += int64(time.Hour / time.Millisecond)
+	if id := n.generate(); id <= last {
+		t.Errorf("unexpected ID %d after %d", id, last)
+	}
+}
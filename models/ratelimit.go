@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxRateLimitPeriod is the longest period of a [RateLimit], the windows are deleted after it
+const MaxRateLimitPeriod = 24 * time.Hour
+
+// IncrementRateLimit counts a request of [key] in the window starting at [windowStart] and returns the number of
+// requests in the window
+func (t TX) IncrementRateLimit(key string, windowStart time.Time) (int64, error) {
+	windowStart = windowStart.UTC()
+	err := t.tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "limit_key"}, {Name: "window_start"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"hits": gorm.Expr("rate_limits.hits + 1")}),
+	}).Create(&RateLimit{LimitKey: key, WindowStart: windowStart, Hits: 1}).Error
+	if err != nil {
+		return 0, err
+	}
+	return t.GetRateLimit(key, windowStart)
+}
+
+// GetRateLimit returns the number of requests of [key] in the window starting at [windowStart]
+func (t TX) GetRateLimit(key string, windowStart time.Time) (int64, error) {
+	var result []RateLimit
+	err := t.tx.Where("limit_key = ? AND window_start = ?", key, windowStart.UTC()).Limit(1).Find(&result).Error
+	if err != nil || len(result) == 0 {
+		return 0, err
+	}
+	return result[0].Hits, nil
+}
+
+// ResetRateLimit forgets the requests of [key] in the window starting at [windowStart]
+func (t TX) ResetRateLimit(key string, windowStart time.Time) error {
+	return t.tx.Where("limit_key = ? AND window_start = ?", key, windowStart.UTC()).Delete(&RateLimit{}).Error
+}
+
+// DeleteRateLimits deletes the windows starting before [before]
+func (t TX) DeleteRateLimits(before time.Time) error {
+	return t.tx.Where("window_start < ?", before.UTC()).Delete(&RateLimit{}).Error
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// the minimum number of minutes between two checks
+	MinCheckInterval = 15
+
+	// how far ahead a cron expression is checked against [MinCheckInterval]
+	cronValidationRuns = 1000
+)
+
+var ErrInvalidSchedule = errors.New("Invalid schedule.")
+
+// Stored as json string. A sentry without a schedule (or with an empty one) is checked every [Sentry.Interval]
+// minutes since it was created.
+// All times are in the time zone of the owner.
+type Schedule struct {
+	// standard cron expression, e.g. "0 7 * * *" for every day at 07:00
+	Cron string `json:"cron,omitempty"`
+
+	// Time window, every [Sentry.Interval] minutes starting from [WindowStart] until [WindowEnd].
+	// The window is the whole day if they are empty.
+	WindowStart string `json:"windowStart,omitempty"` // "15:04"
+	WindowEnd   string `json:"windowEnd,omitempty"`   // "15:04", "24:00" for the end of the day
+	Weekdays    []int  `json:"weekdays,omitempty"`    // 0 is Sunday, empty means every day
+}
+
+func (s *Schedule) IsZero() bool {
+	return s.Cron == "" && s.WindowStart == "" && s.WindowEnd == "" && len(s.Weekdays) == 0
+}
+
+// parseClock returns the minutes since midnight
+func parseClock(clock string) (int, error) {
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *Schedule) window() (start int, end int, err error) {
+	start, end = 0, 24*60
+	if s.WindowStart != "" {
+		start, err = parseClock(s.WindowStart)
+		if err != nil {
+			return
+		}
+	}
+	if s.WindowEnd != "" {
+		end, err = parseClock(s.WindowEnd)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Schedule) parseCron() (cron.Schedule, error) {
+	// the time zone always comes from the owner
+	if strings.HasPrefix(s.Cron, "TZ=") || strings.HasPrefix(s.Cron, "CRON_TZ=") {
+		return nil, fmt.Errorf("%w time zone is not allowed in cron expression", ErrInvalidSchedule)
+	}
+	c, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidSchedule, err)
+	}
+	return c, nil
+}
+
+// Validate checks the schedule and makes sure there are at least [MinCheckInterval] minutes between two checks.
+// The interval used within a time window is checked separately.
+func (s *Schedule) Validate() error {
+	if s.Cron != "" {
+		if s.WindowStart != "" || s.WindowEnd != "" || len(s.Weekdays) != 0 {
+			return fmt.Errorf("%w cron expression can't be used with time window", ErrInvalidSchedule)
+		}
+		c, err := s.parseCron()
+		if err != nil {
+			return err
+		}
+		t := c.Next(time.Now())
+		if t.IsZero() {
+			return fmt.Errorf("%w cron expression never runs", ErrInvalidSchedule)
+		}
+		for i := 0; i < cronValidationRuns; i++ {
+			next := c.Next(t)
+			if next.IsZero() {
+				break
+			}
+			if next.Sub(t) < MinCheckInterval*time.Minute {
+				return fmt.Errorf("%w cron expression runs more than once in %d minutes", ErrInvalidSchedule, MinCheckInterval)
+			}
+			t = next
+		}
+		return nil
+	}
+
+	start, end, err := s.window()
+	if err != nil {
+		return fmt.Errorf("%w %v", ErrInvalidSchedule, err)
+	}
+	if start >= end {
+		return fmt.Errorf("%w time window ends before it starts", ErrInvalidSchedule)
+	}
+	for _, d := range s.Weekdays {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("%w invalid weekday: %d", ErrInvalidSchedule, d)
+		}
+	}
+	return nil
+}
+
+func (s *Schedule) hasWeekday(d time.Weekday) bool {
+	if len(s.Weekdays) == 0 {
+		return true
+	}
+	for _, w := range s.Weekdays {
+		if time.Weekday(w) == d {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the first check time after [after]. The schedule must be valid and not zero.
+func (s *Schedule) Next(after time.Time, interval int, loc *time.Location) time.Time {
+	after = after.In(loc)
+
+	if s.Cron != "" {
+		c, err := s.parseCron()
+		if err != nil {
+			return time.Time{}
+		}
+		return c.Next(after)
+	}
+
+	start, end, _ := s.window()
+	step := time.Duration(interval) * time.Minute
+	y, m, d := after.Date()
+	// there is at least one day in a week
+	for i := 0; i <= 7; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, loc)
+		if !s.hasWeekday(day.Weekday()) {
+			continue
+		}
+		// not [day.Add], the day may be shorter or longer because of daylight saving time
+		windowStart := time.Date(y, m, d+i, 0, start, 0, 0, loc)
+		windowEnd := time.Date(y, m, d+i, 0, end, 0, 0, loc)
+		if after.Before(windowStart) {
+			return windowStart
+		}
+		next := windowStart.Add((after.Sub(windowStart)/step + 1) * step)
+		if next.Before(windowEnd) {
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -1,39 +1,65 @@
 package models
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"hash/fnv"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+const (
+	// a sentry goes to [RSError] after this many failed checks in a row
+	MaxConsecutiveFailures = 5
+	// the delay before retrying a failed check, doubled on each failure and capped at the interval
+	retryBaseDelay = time.Minute
+)
+
+var maxCheckJitter time.Duration
+
 var (
 	ErrSentryNotRunning      = errors.New("Sentry is not in running state.")
 	ErrInvalidNotificationID = errors.New("Invalid notification ID.")
 	ErrZeroAffectedRows      = errors.New("Zero affected rows.")
 )
 
-// If there isn't an unchecked sentry, it returns (nil, nil, nil)
+// If there isn't an unchecked sentry, it returns (nil, nil, nil).
+// It is safe to be called by several masters at the same time, each sentry is only returned to one of them.
 func (t TX) GetUncheckedSentry() (*Sentry, *SentryImage, error) {
 	var sResult Sentry
-	now := time.Now()
-	err := t.tx.Where("next_check_time <= ?", now).Where("running_state", RSRunning).Order("next_check_time").First(&sResult).Error
-	if err != nil {
-		if IsErrNoDocument(err) {
+	var now time.Time
+	for {
+		now = time.Now()
+		// rows locked by other masters are skipped, SQLite ignores it and locks the whole database instead
+		r := t.tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("next_check_time <= ?", now).Where("running_state", RSRunning).Order("next_check_time").
+			Limit(1).Find(&sResult)
+		if r.Error != nil {
+			return nil, nil, r.Error
+		}
+		if r.RowsAffected == 0 {
 			return nil, nil, nil
 		}
-		return nil, nil, err
-	}
-	// delay selected sentry 10 min
-	err = t.tx.Model(&sResult).Update("next_check_time", now.Add(time.Minute*10)).Error
-	if err != nil {
-		return nil, nil, err
+
+		// delay selected sentry 10 min
+		r = t.tx.Model(&Sentry{}).Where("id = ?", sResult.ID).Where("next_check_time <= ?", now).
+			Update("next_check_time", now.Add(time.Minute*10))
+		if r.Error != nil {
+			return nil, nil, r.Error
+		}
+		// otherwise it has been picked by others in the meantime
+		if r.RowsAffected == 1 {
+			break
+		}
 	}
 	if sResult.LatestImageID == nil {
 		return &sResult, nil, nil
 	}
 	var iResult SentryImage
-	err = t.tx.First(&iResult, *sResult.LatestImageID).Error
+	err := t.tx.First(&iResult, *sResult.LatestImageID).Error
 	return &sResult, &iResult, err
 }
 
@@ -48,6 +74,20 @@ func (t TX) GetSentry(id int64) (*Sentry, error) {
 	return &result, err
 }
 
+// GetUserSentry returns the sentry owned by [userID] and its latest image, which is nil if it was never checked.
+func (t TX) GetUserSentry(id int64, userID int64) (*Sentry, *SentryImage, error) {
+	err := t.sentryCheckOwner(id, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := t.GetSentry(id)
+	if err != nil || s.LatestImageID == nil {
+		return s, nil, err
+	}
+	i, err := t.GetSentryImage(*s.LatestImageID)
+	return s, i, err
+}
+
 func (t TX) CreateSentry(s *Sentry) (int64, error) {
 	s.ID = snowflakeNode.Generate().Int64()
 	err := t.notificationCheckOwner(s.NotificationID, s.UserID)
@@ -79,8 +119,113 @@ func (t TX) UpdateSentry(sid int64, uid int64, s *Sentry) error {
 	}
 	s.ID = sid
 
+	if s.RunningState == RSRunning {
+		// give it a fresh start when it is resumed after errors
+		err = t.tx.Model(&Sentry{ID: sid}).Where("running_state = ?", RSError).Updates(map[string]interface{}{
+			"consecutive_failures": 0,
+			"next_check_time":      time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
 	// TODO: update the "NextCheckTime" when setting "RunningState" to "Running"
-	return t.tx.Model(s).Updates(s).Error
+	err = t.tx.Model(s).Updates(s).Error
+	if err != nil {
+		return err
+	}
+
+	if s.RunningState == RSPaused {
+		err = t.CancelSentryTasks(sid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Schedule != "" || s.Interval != 0 {
+		// follow the new schedule from now on
+		var result Sentry
+		err = t.tx.Select([]string{"id", "user_id", "interval", "schedule", "created_at", "next_check_time"}).First(&result, sid).Error
+		if err != nil {
+			return err
+		}
+		next, err := t.nextCheckTime(&result, time.Now())
+		if err != nil {
+			return err
+		}
+		if next.Before(result.NextCheckTime) {
+			return t.tx.Model(&Sentry{ID: sid}).Update("next_check_time", next).Error
+		}
+	}
+	return nil
+}
+
+// SetMaxCheckJitter sets the upper bound of [checkJitter]
+func SetMaxCheckJitter(d time.Duration) {
+	maxCheckJitter = d
+}
+
+// checkJitter is a fixed delay derived from the ID of the sentry, so that sentries with the same
+// interval are not all checked at the same moment. It is at most a quarter of the interval.
+// It is not applied to sentries with a [Schedule].
+func checkJitter(s *Sentry) time.Duration {
+	max := minDuration(maxCheckJitter, time.Minute*time.Duration(s.Interval)/4) / time.Second
+	if max <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.LittleEndian, s.ID)
+	return time.Duration(h.Sum64()%uint64(max)) * time.Second
+}
+
+// nextCheckTime returns the first check time of the sentry after [after]. It needs [Sentry.ID], [Sentry.UserID],
+// [Sentry.Interval], [Sentry.Schedule] and [Sentry.CreatedAt].
+func (t TX) nextCheckTime(s *Sentry, after time.Time) (time.Time, error) {
+	var schedule Schedule
+	if s.Schedule != "" {
+		err := json.Unmarshal([]byte(s.Schedule), &schedule)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	interval := time.Minute * time.Duration(s.Interval)
+	if schedule.IsZero() {
+		// every check of the sentry is shifted by the same amount, so the interval is kept.
+		// Cron and time window schedules are not shifted, they must run at the given times.
+		start := s.CreatedAt.Add(checkJitter(s))
+		tc := after.Sub(start)/interval + 1
+		return start.Add(tc * interval), nil
+	}
+
+	// schedules are evaluated in the time zone of the owner
+	loc := time.UTC
+	u, err := t.GetUserByID(s.UserID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if u != nil {
+		if l, err := time.LoadLocation(u.TimeZone); err == nil {
+			loc = l
+		}
+	}
+
+	next := schedule.Next(after, s.Interval, loc)
+	if next.IsZero() {
+		// it shouldn't happen to a valid schedule, but never stop checking
+		next = after.Add(interval)
+	}
+	return next, nil
+}
+
+// UpdateSentryRequiredTags is separate from [UpdateSentry] because the tags can be cleared
+func (t TX) UpdateSentryRequiredTags(sid int64, uid int64, tags []string) error {
+	err := t.sentryCheckOwner(sid, uid)
+	if err != nil {
+		return err
+	}
+	return t.tx.Model(&Sentry{ID: sid}).Update("required_tags", NormalizeTags(tags)).Error
 }
 
 func (t TX) DeleteSentry(id int64, uid int64) error {
@@ -88,6 +233,10 @@ func (t TX) DeleteSentry(id int64, uid int64) error {
 	if err != nil {
 		return err
 	}
+	err = t.CancelSentryTasks(id)
+	if err != nil {
+		return err
+	}
 	return t.tx.Delete(&Sentry{ID: id}).Error
 }
 
@@ -96,6 +245,15 @@ func (t TX) GetImageHistory(id int64) (results []SentryImage, err error) {
 	return
 }
 
+func (t TX) GetSentryImage(id uint) (*SentryImage, error) {
+	var result SentryImage
+	err := t.tx.First(&result, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 func (t TX) GetSentryName(id int64) (string, error) {
 	var result Sentry
 	err := t.tx.Select("name").First(&result, id).Error
@@ -108,10 +266,14 @@ func (t TX) GetSentryNotification(id int64) (int64, error) {
 	return result.NotificationID, err
 }
 
-func (t TX) UpdateSentryAfterCheck(id int64, changed bool, newImage string) error {
+// UpdateSentryAfterCheck records a successful check. If [changed], [newImage] is added to the history and becomes the
+// latest one, the sentry is notified of it if [notified] too.
+func (t TX) UpdateSentryAfterCheck(id int64, changed bool, notified bool, newImage string, diffImage string) error {
 
 	var result Sentry
-	err := t.tx.Select("interval, created_at, notify_count, check_count, last_check_time, running_state").First(&result, id).Error
+	// "interval" is a reserved word in MySQL, passing the columns separately lets gorm quote them
+	err := t.tx.Select([]string{"id", "user_id", "interval", "schedule", "created_at", "notify_count",
+		"check_count", "last_check_time", "running_state", "consecutive_failures"}).First(&result, id).Error
 	if err != nil {
 		return err
 	}
@@ -123,10 +285,11 @@ func (t TX) UpdateSentryAfterCheck(id int64, changed bool, newImage string) erro
 	var sentry Sentry
 
 	now := time.Now()
-	tc := (int(now.Sub(result.CreatedAt).Minutes()) / result.Interval) + 1
-	firstTime := result.LastCheckTime == nil
 	sentry.LastCheckTime = &now
-	sentry.NextCheckTime = result.CreatedAt.Add(time.Minute * time.Duration(tc*result.Interval))
+	sentry.NextCheckTime, err = t.nextCheckTime(&result, now)
+	if err != nil {
+		return err
+	}
 	sentry.CheckCount = result.CheckCount + 1
 
 	if changed {
@@ -134,20 +297,88 @@ func (t TX) UpdateSentryAfterCheck(id int64, changed bool, newImage string) erro
 		sentryImage := SentryImage{
 			SentryID: id,
 			File:     newImage,
+			DiffFile: diffImage,
 		}
 		err = t.tx.Create(&sentryImage).Error
 		if err != nil {
 			return err
 		}
 		sentry.LatestImageID = &sentryImage.ID
-		if !firstTime {
+		if notified {
 			sentry.NotifyCount = result.NotifyCount + 1
 		}
 	}
 
+	if result.ConsecutiveFailures != 0 {
+		err = t.tx.Model(&Sentry{ID: id}).Update("consecutive_failures", 0).Error
+		if err != nil {
+			return err
+		}
+	}
+
 	return t.tx.Model(&Sentry{ID: id}).Updates(&sentry).Error
 }
 
+// UpdateSentryAfterFailure records a failed check and schedules a retry with exponential backoff,
+// but not later than the next scheduled check.
+// After [MaxConsecutiveFailures] the sentry is moved to [RSError] and its tasks are cancelled, in which case it
+// returns true.
+func (t TX) UpdateSentryAfterFailure(id int64, msg string) (bool, error) {
+	var result Sentry
+	err := t.tx.Select([]string{"id", "user_id", "interval", "schedule", "created_at", "running_state",
+		"consecutive_failures"}).First(&result, id).Error
+	if err != nil {
+		return false, err
+	}
+
+	if result.RunningState != RSRunning {
+		return false, ErrSentryNotRunning
+	}
+
+	now := time.Now()
+	sentry := Sentry{
+		ConsecutiveFailures: result.ConsecutiveFailures + 1,
+		LastError:           msg,
+		LastErrorTime:       &now,
+	}
+
+	// no later than the next scheduled check
+	next, err := t.nextCheckTime(&result, now)
+	if err != nil {
+		return false, err
+	}
+	delay := next.Sub(now)
+	// avoid overflow
+	if sentry.ConsecutiveFailures < 16 {
+		delay = minDuration(delay, retryBaseDelay<<(sentry.ConsecutiveFailures-1))
+	}
+	sentry.NextCheckTime = now.Add(delay)
+
+	if sentry.ConsecutiveFailures >= MaxConsecutiveFailures {
+		sentry.RunningState = RSError
+	}
+
+	err = t.tx.Model(&Sentry{ID: id}).Updates(&sentry).Error
+	if err != nil {
+		return false, err
+	}
+
+	if sentry.RunningState == RSError {
+		err = t.CancelSentryTasks(id)
+		if err != nil {
+			return false, err
+		}
+	}
+	return sentry.RunningState == RSError, nil
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func (t TX) sentryCheckOwner(id int64, userID int64) error {
 	var count int64
 	err := t.tx.Model(&Sentry{}).Where(&Sentry{ID: id, UserID: userID}).Count(&count).Error
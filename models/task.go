@@ -0,0 +1,329 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+)
+
+var ErrTaskNotAssignable = errors.New("Task is not in a state that accepts results.")
+
+// Task IDs are sent to workers of [ProtocolV1] as JSON numbers, which they read as float64. So they are like
+// snowflake IDs with fewer bits, below [MaxSafeTaskID]: 41 bits of milliseconds since [taskIDEpoch], 10 bits of
+// node ID and 2 bits of sequence.
+const (
+	taskIDNodeBits = 10
+	taskIDStepBits = 2
+	// MaxSafeTaskID is the largest ID a float64 holds exactly. Tasks created by older versions may be larger.
+	MaxSafeTaskID = 1<<53 - 1
+)
+
+// 2024-01-01 UTC, in milliseconds
+const taskIDEpoch = 1704067200000
+
+var taskIDs *taskIDNode
+
+type taskIDNode struct {
+	mu   sync.Mutex
+	node int64
+	time int64 // milliseconds since [taskIDEpoch] of the last ID
+	step int64
+}
+
+// generate returns a new task ID. When the sequence of a millisecond is used up (or the clock goes back) it
+// continues with the next millisecond, instead of waiting for it.
+func (n *taskIDNode) generate() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now().UnixMilli() - taskIDEpoch
+	if now > n.time {
+		n.time = now
+		n.step = 0
+	} else {
+		n.step = (n.step + 1) & (1<<taskIDStepBits - 1)
+		if n.step == 0 {
+			n.time++
+		}
+	}
+	return n.time<<(taskIDNodeBits+taskIDStepBits) | n.node<<taskIDStepBits | n.step
+}
+
+// CreateTask inserts the task in queued state. IDs are never reused, so a late result can't be mistaken for
+// the result of another task.
+func (t TX) CreateTask(task *Task) error {
+	task.ID = taskIDs.generate()
+	task.State = TSQueued
+	if task.AvailableAt.IsZero() {
+		task.AvailableAt = time.Now()
+	}
+	return t.tx.Create(task).Error
+}
+
+// LastHostTaskTime returns the latest [Task.AvailableAt] of the tasks for [host], or zero time if there isn't any.
+func (t TX) LastHostTaskTime(host string) (time.Time, error) {
+	var task Task
+	err := t.tx.Select("available_at").Where(&Task{Host: host}).Order("available_at DESC").Limit(1).Find(&task).Error
+	return task.AvailableAt, err
+}
+
+func (t TX) GetTask(id int64) (*Task, error) {
+	var result Task
+	err := t.tx.First(&result, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// TaskFilter limits the tasks that can be claimed
+type TaskFilter struct {
+	// tasks of a host that already has this many assigned tasks are skipped, 0 means unlimited
+	HostConcurrency int
+	// the modes the worker is allowed to run, nil means all
+	Modes []TaskMode
+	// tags of the worker, tasks requiring other tags are skipped, at most [MaxWorkerTags]
+	Tags []string
+	// features of the worker, see [FeatureMask]. Tasks requiring others are skipped.
+	Features int64
+	// tasks with larger IDs are skipped, 0 means unlimited
+	MaxID int64
+}
+
+// ClaimNextTask assigns the queued task with the highest priority that passes [filter] to [workerID] until
+// the lease expires.
+// Several masters may claim tasks at the same time, rows locked by others are skipped. The host limit
+// may be exceeded slightly in this case.
+// If there isn't a queued task, it returns (nil, nil).
+func (t TX) ClaimNextTask(workerID string, lease time.Duration, filter TaskFilter) (*Task, error) {
+	if filter.Modes != nil && len(filter.Modes) == 0 {
+		return nil, nil
+	}
+	if len(filter.Tags) > MaxWorkerTags {
+		return nil, errors.WithStack(ErrInvalidTag)
+	}
+	for {
+		now := time.Now()
+		var task Task
+		// SKIP LOCKED requires MySQL 8.0 / MariaDB 10.6, it is ignored by SQLite which locks the whole database
+		q := t.tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where(&Task{State: TSQueued}).Where("expire_at > ? AND available_at <= ?", now, now)
+		if filter.HostConcurrency > 0 {
+			busyHosts := t.tx.Model(&Task{}).Select("host").Where(&Task{State: TSAssigned}).Where("host <> ''").
+				Group("host").Having("COUNT(*) >= ?", filter.HostConcurrency)
+			q = q.Where("host = '' OR host NOT IN (?)", busyHosts)
+		}
+		if filter.Modes != nil {
+			q = q.Where("mode IN ?", filter.Modes)
+		}
+		if filter.MaxID > 0 {
+			q = q.Where("id <= ?", filter.MaxID)
+		}
+		// tasks without required tags match the empty subset, so they are never held back by tagged ones
+		q = q.Where("required_tags IN ?", tagSubsets(filter.Tags))
+		q = q.Where("(required_features & ?) = 0", allFeatures()&^filter.Features)
+		r := q.Order("priority DESC").Order("mode").Order("created_at").Limit(1).Find(&task)
+		if r.Error != nil || r.RowsAffected == 0 {
+			return nil, r.Error
+		}
+
+		r = t.tx.Model(&Task{}).Where(&Task{ID: task.ID, State: TSQueued}).Updates(&Task{
+			State:    TSAssigned,
+			ExpireAt: now.Add(lease),
+			WorkerID: workerID,
+			Attempts: task.Attempts + 1,
+		})
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		// taken by others in the meantime
+		if r.RowsAffected != 1 {
+			continue
+		}
+
+		task.State = TSAssigned
+		task.ExpireAt = now.Add(lease)
+		task.WorkerID = workerID
+		task.Attempts++
+		return &task, nil
+	}
+}
+
+// ExtendTaskLease extends the lease of a task assigned to [workerID]. It returns true if the task has been
+// cancelled, in which case the worker should stop working on it.
+func (t TX) ExtendTaskLease(id int64, workerID string, lease time.Duration) (bool, error) {
+	r := t.tx.Model(&Task{}).Where("id = ? AND state = ? AND worker_id = ?", id, TSAssigned, workerID).
+		Update("expire_at", time.Now().Add(lease))
+	if r.Error != nil {
+		return false, r.Error
+	}
+	if r.RowsAffected == 1 {
+		return false, nil
+	}
+
+	var count int64
+	err := t.tx.Model(&Task{}).Where("id = ? AND state = ? AND worker_id = ?", id, TSCancelled, workerID).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, ErrTaskNotAssignable
+	}
+	return true, nil
+}
+
+// CancelSentryTasks cancels the queued and assigned tasks of the sentry. They are deleted once they would
+// have expired, until then a worker running one is told to stop when it extends the lease.
+func (t TX) CancelSentryTasks(sentryID int64) error {
+	return t.tx.Model(&Task{}).Where(&Task{Mode: TMSentry, SentryID: sentryID}).
+		Where("state IN ?", []TaskState{TSQueued, TSAssigned}).Update("state", TSCancelled).Error
+}
+
+// FinishTask records the result of a task assigned to [workerID]. A task can only be finished once and only within
+// the lease of the worker, otherwise it returns [ErrTaskNotAssignable]. The result is kept for [retention].
+func (t TX) FinishTask(id int64, workerID string, feedbackCode int, feedbackMsg string, imageToken string,
+	retention time.Duration) error {
+	state := TSCompleted
+	if feedbackCode != 0 {
+		state = TSFailed
+	}
+	now := time.Now()
+	r := t.tx.Model(&Task{}).Where("id = ? AND state = ? AND worker_id = ?", id, TSAssigned, workerID).
+		Where("expire_at > ?", now).Updates(map[string]interface{}{
+		"state":         state,
+		"feedback_code": feedbackCode,
+		"feedback_msg":  feedbackMsg,
+		"image_token":   imageToken,
+		"expire_at":     now.Add(retention),
+	})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected != 1 {
+		return ErrTaskNotAssignable
+	}
+	return nil
+}
+
+// FinishSentryTaskProcessing keeps the result of a processed sentry task for [retention], so that it can be
+// read by the user who requested the check.
+func (t TX) FinishSentryTaskProcessing(id int64, similarity *float64, changed bool, errMsg string, retention time.Duration) error {
+	values := map[string]interface{}{
+		"state":      TSProcessed,
+		"similarity": similarity,
+		"changed":    changed,
+		"expire_at":  time.Now().Add(retention),
+	}
+	if errMsg != "" {
+		values["feedback_msg"] = errMsg
+	}
+	return t.tx.Model(&Task{ID: id}).Updates(values).Error
+}
+
+// GetActiveSentryTask returns the queued or assigned task of the sentry, or nil if there isn't one.
+func (t TX) GetActiveSentryTask(sentryID int64) (*Task, error) {
+	var task Task
+	r := t.tx.Where(&Task{Mode: TMSentry, SentryID: sentryID}).Where("state IN ?", []TaskState{TSQueued, TSAssigned}).
+		Limit(1).Find(&task)
+	if r.Error != nil || r.RowsAffected == 0 {
+		return nil, r.Error
+	}
+	return &task, nil
+}
+
+// PrioritizeTask raises the priority of a task and records the user who is waiting for it.
+// It is made available right away if it was held back.
+func (t TX) PrioritizeTask(id int64, priority int, userID int64) error {
+	err := t.tx.Model(&Task{ID: id}).Updates(&Task{Priority: priority, UserID: userID}).Error
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return t.tx.Model(&Task{ID: id}).Where("available_at > ?", now).Update("available_at", now).Error
+}
+
+func (t TX) DeleteTask(id int64) error {
+	return t.tx.Delete(&Task{ID: id}).Error
+}
+
+func (t TX) CountQueuedTasks() (count int64, err error) {
+	err = t.tx.Model(&Task{}).Where(&Task{State: TSQueued}).Where("expire_at > ?", time.Now()).Count(&count).Error
+	return
+}
+
+// GetUnprocessedSentryTasks returns sentry tasks that have a result from the worker but haven't been compared.
+func (t TX) GetUnprocessedSentryTasks() (results []Task, err error) {
+	err = t.tx.Where(&Task{Mode: TMSentry}).Where("state IN ?", []TaskState{TSCompleted, TSFailed}).
+		Where("expire_at <= ?", time.Now()).Find(&results).Error
+	return
+}
+
+// ClaimTaskResult makes sure that the result of a sentry task is only processed by one master at a time.
+// Once done or failed, [ExpireAt] of a sentry task is the time until which it is being processed by someone.
+// It returns false if it has been claimed by others.
+func (t TX) ClaimTaskResult(id int64, lease time.Duration) (bool, error) {
+	now := time.Now()
+	r := t.tx.Model(&Task{}).Where("id = ? AND state IN ?", id, []TaskState{TSCompleted, TSFailed}).
+		Where("expire_at <= ?", now).Update("expire_at", now.Add(lease))
+	return r.RowsAffected == 1, r.Error
+}
+
+// RequeueExpiredTasks puts assigned tasks whose lease has expired back to the queue. A task that has been tried
+// [maxAttempts] times is marked as failed instead. It returns the requeued tasks and the failed tasks.
+func (t TX) RequeueExpiredTasks(maxAttempts int, queueTimeout func(TaskMode) time.Duration) (requeued []Task, failed []Task, err error) {
+	now := time.Now()
+	var expired []Task
+	err = t.tx.Where(&Task{State: TSAssigned}).Where("expire_at <= ?", now).Find(&expired).Error
+	if err != nil {
+		return
+	}
+
+	for _, task := range expired {
+		if task.Attempts >= maxAttempts {
+			task.State = TSFailed
+			task.FeedbackMsg = "lease expired"
+			task.ExpireAt = now
+			err = t.tx.Model(&Task{ID: task.ID}).Updates(&Task{
+				State:       task.State,
+				FeedbackMsg: task.FeedbackMsg,
+				ExpireAt:    task.ExpireAt,
+			}).Error
+			if err != nil {
+				return
+			}
+			failed = append(failed, task)
+			continue
+		}
+
+		task.State = TSQueued
+		task.ExpireAt = now.Add(queueTimeout(task.Mode))
+		err = t.tx.Model(&Task{ID: task.ID}).Updates(&Task{
+			State:    task.State,
+			ExpireAt: task.ExpireAt,
+		}).Error
+		if err != nil {
+			return
+		}
+		requeued = append(requeued, task)
+	}
+	return
+}
+
+// DeleteStaleTasks deletes full screenshot tasks and processed sentry tasks that are no longer needed, tasks
+// that expired in the queue and cancelled tasks. It returns the IDs of deleted tasks.
+func (t TX) DeleteStaleTasks() ([]int64, error) {
+	now := time.Now()
+	var ids []int64
+	err := t.tx.Model(&Task{}).
+		Where("expire_at <= ?", now).
+		Where("state IN ? OR (state IN ? AND mode = ?)", []TaskState{TSQueued, TSProcessed, TSCancelled}, []TaskState{TSCompleted, TSFailed},
+			TMFullScreenshot).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return ids, t.tx.Delete(&Task{}, ids).Error
+}
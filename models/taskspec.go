@@ -0,0 +1,283 @@
+package models
+
+import (
+	"encoding/json"
+	"image"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TaskSchema is the version of [TaskSpec]. Fields added later have to be optional or come with a new feature,
+// so that workers speaking an older protocol keep working.
+const TaskSchema = 1
+
+// versions of the worker protocol
+const (
+	// workers that don't negotiate, they are assumed to have [LegacyFeatures]
+	ProtocolV1 = 1
+	// the worker reports its features in [WorkerInit] and tasks carry [TaskSpec.Schema]
+	ProtocolV2      = 2
+	CurrentProtocol = ProtocolV2
+)
+
+// features a task can require, it is not assigned to workers lacking any of them
+const (
+	FeatureScreenshot = "screenshot"
+	FeatureClip       = "clip"
+	FeatureFullPage   = "fullPage"
+	FeaturePNG        = "png"
+	FeatureJPG        = "jpg"
+	// [TaskTypeText]
+	FeatureText = "text"
+)
+
+// the index is the bit of the feature in [Task.RequiredFeatures] and [Worker.Features], only append to it
+var features = []string{FeatureScreenshot, FeatureClip, FeatureFullPage, FeaturePNG, FeatureJPG, FeatureText}
+
+// LegacyFeatures are the features of every worker written before the protocol was versioned
+var LegacyFeatures = FeatureMask([]string{FeatureScreenshot, FeatureClip, FeatureFullPage, FeaturePNG, FeatureJPG})
+
+var ErrInvalidTaskSpec = errors.New("Invalid task.")
+
+// types of tasks
+const (
+	// an image of [TaskSpec.Clip] or the whole page
+	TaskTypeScreenshot = "screenshot"
+	// the content of the elements matching [TaskSpec.Selector], one element per line
+	TaskTypeText = "text"
+)
+
+// what a text task extracts from the elements
+const (
+	ExtractText = "text" // the rendered text, e.g. innerText
+	ExtractHTML = "html" // the markup, e.g. outerHTML
+)
+
+// the maximum length of [TaskSpec.Selector]
+const maxSelectorLength = 1000
+
+// MaxRegions is the maximum number of [TaskSpec.Regions]
+const MaxRegions = 10
+
+// the maximum length of [Region.Name]
+const maxRegionNameLength = 50
+
+// FeatureMask returns the bits of the known features in [names], others are ignored
+func FeatureMask(names []string) int64 {
+	var mask int64
+	for _, name := range names {
+		for i, f := range features {
+			if f == name {
+				mask |= 1 << i
+			}
+		}
+	}
+	return mask
+}
+
+// FeatureNames is the reverse of [FeatureMask]
+func FeatureNames(mask int64) []string {
+	names := []string{}
+	for i, f := range features {
+		if mask&(1<<i) != 0 {
+			names = append(names, f)
+		}
+	}
+	return names
+}
+
+func allFeatures() int64 {
+	return 1<<len(features) - 1
+}
+
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (r Rect) Rectangle() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// Region is a named area of the page, e.g. `{"name":"price","x":0,"y":120,"width":200,"height":40}`
+type Region struct {
+	Name string `json:"name"`
+	Rect
+}
+
+type Viewport struct {
+	Width    int  `json:"width"`
+	IsMobile bool `json:"isMobile"`
+}
+
+type TaskOutput struct {
+	Type        string `json:"type"` // "png" or "jpg"
+	Progressive bool   `json:"progressive,omitempty"`
+	Quality     int    `json:"quality,omitempty"` // jpg only
+}
+
+// TaskSpec is what a worker has to do, it is stored as json in [Sentry.Task] and [Task.Task].
+type TaskSpec struct {
+	Schema   int        `json:"schema"`
+	Type     string     `json:"type,omitempty"` // empty for [TaskTypeScreenshot]
+	URL      string     `json:"url"`
+	Timeout  int        `json:"timeout"` // milliseconds
+	FullPage bool       `json:"fullPage"`
+	Clip     *Rect      `json:"clip,omitempty"`
+	Viewport Viewport   `json:"viewport"`
+	Output   TaskOutput `json:"output"`
+
+	// areas of the page that are compared independently, [TaskSpec.Clip] is the smallest rectangle containing them
+	// so that they are taken in one screenshot. Workers don't need to know about them.
+	Regions []Region `json:"regions,omitempty"`
+
+	// [TaskTypeText] only
+	Selector string `json:"selector,omitempty"` // CSS selector
+	Extract  string `json:"extract,omitempty"`  // [ExtractText] or [ExtractHTML]
+}
+
+// ParseTaskSpec parses and validates a stored task. Tasks stored before the schema was versioned are schema 1.
+func ParseTaskSpec(s string) (*TaskSpec, error) {
+	var spec TaskSpec
+	err := json.Unmarshal([]byte(s), &spec)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if spec.Schema == 0 {
+		spec.Schema = 1
+	}
+	return &spec, spec.Validate()
+}
+
+func (s *TaskSpec) Validate() error {
+	if s.Schema < 1 || s.Schema > TaskSchema {
+		return errors.Wrapf(ErrInvalidTaskSpec, "unknown schema %d", s.Schema)
+	}
+	u, err := url.ParseRequestURI(s.URL)
+	if err != nil || !(strings.EqualFold(u.Scheme, "http") || strings.EqualFold(u.Scheme, "https")) {
+		return errors.Wrap(ErrInvalidTaskSpec, "invalid url")
+	}
+	if s.Timeout <= 0 || s.Viewport.Width <= 0 {
+		return errors.Wrap(ErrInvalidTaskSpec, "invalid timeout or viewport")
+	}
+	switch s.GetType() {
+	case TaskTypeScreenshot:
+	case TaskTypeText:
+		if s.Selector == "" || len(s.Selector) > maxSelectorLength {
+			return errors.Wrap(ErrInvalidTaskSpec, "invalid selector")
+		}
+		if s.Extract != ExtractText && s.Extract != ExtractHTML {
+			return errors.Wrapf(ErrInvalidTaskSpec, "unknown extract %q", s.Extract)
+		}
+		if len(s.Regions) > 0 {
+			return errors.Wrap(ErrInvalidTaskSpec, "regions on a text task")
+		}
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidTaskSpec, "unknown type %q", s.Type)
+	}
+	if c := s.Clip; c != nil && (c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0) {
+		return errors.Wrap(ErrInvalidTaskSpec, "invalid clip")
+	}
+	if err := s.validateRegions(); err != nil {
+		return err
+	}
+	if s.Output.Type != "png" && s.Output.Type != "jpg" {
+		return errors.Wrapf(ErrInvalidTaskSpec, "unknown output type %q", s.Output.Type)
+	}
+	return nil
+}
+
+func (s *TaskSpec) validateRegions() error {
+	if len(s.Regions) == 0 {
+		return nil
+	}
+	if len(s.Regions) > MaxRegions {
+		return errors.Wrap(ErrInvalidTaskSpec, "too many regions")
+	}
+	if s.Clip == nil {
+		return errors.Wrap(ErrInvalidTaskSpec, "regions without a clip")
+	}
+	names := make(map[string]bool)
+	for _, r := range s.Regions {
+		if r.Name == "" || len(r.Name) > maxRegionNameLength || names[r.Name] {
+			return errors.Wrapf(ErrInvalidTaskSpec, "invalid region name %q", r.Name)
+		}
+		names[r.Name] = true
+		// inside the clip, compared without adding them up
+		c := s.Clip
+		if r.X < c.X || r.Y < c.Y || r.Width <= 0 || r.Height <= 0 || r.Width > c.Width-(r.X-c.X) ||
+			r.Height > c.Height-(r.Y-c.Y) {
+			return errors.Wrapf(ErrInvalidTaskSpec, "invalid region %q", r.Name)
+		}
+	}
+	return nil
+}
+
+// RegionsClip returns the smallest rectangle containing the regions, nil if there isn't any
+func RegionsClip(regions []Region) *Rect {
+	if len(regions) == 0 {
+		return nil
+	}
+	bounds := regions[0].Rectangle()
+	for _, r := range regions[1:] {
+		bounds = bounds.Union(r.Rectangle())
+	}
+	return &Rect{X: bounds.Min.X, Y: bounds.Min.Y, Width: bounds.Dx(), Height: bounds.Dy()}
+}
+
+// RegionRectangle returns the area of the region in the image taken by the task, which is relative to
+// [TaskSpec.Clip]
+func (s *TaskSpec) RegionRectangle(r Region) image.Rectangle {
+	rect := r.Rectangle()
+	if s.Clip != nil {
+		rect = rect.Sub(image.Pt(s.Clip.X, s.Clip.Y))
+	}
+	return rect
+}
+
+// GetType returns [TaskSpec.Type], or [TaskTypeScreenshot] if it is empty
+func (s *TaskSpec) GetType() string {
+	if s.Type == "" {
+		return TaskTypeScreenshot
+	}
+	return s.Type
+}
+
+// Host is the lowercase host name of [TaskSpec.URL]
+func (s *TaskSpec) Host() string {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// RequiredFeatures returns the features a worker needs to run the task, see [FeatureMask]
+func (s *TaskSpec) RequiredFeatures() int64 {
+	if s.GetType() == TaskTypeText {
+		return FeatureMask([]string{FeatureText})
+	}
+	names := []string{FeatureScreenshot}
+	if s.Clip != nil {
+		names = append(names, FeatureClip)
+	}
+	if s.FullPage {
+		names = append(names, FeatureFullPage)
+	}
+	if s.Output.Type == "png" {
+		names = append(names, FeaturePNG)
+	} else {
+		names = append(names, FeatureJPG)
+	}
+	return FeatureMask(names)
+}
+
+func (s *TaskSpec) JSON() (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), errors.WithStack(err)
+}
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"encoding/json"
+	"image"
+
+	"github.com/pkg/errors"
+)
+
+// algorithms comparing the new image of a sentry with the latest one, each has its own threshold in [Trigger]
+const (
+	// the average difference of the RGB channels, changed if the similarity is below [Trigger.SimilarityThreshold]
+	AlgorithmMeanDifference = "meanDifference"
+	// structural similarity of the luminance, changed if it is below [Trigger.SSIMThreshold]
+	AlgorithmSSIM = "ssim"
+	// 64 bit difference hash, changed if more than [Trigger.HashDistance] bits differ
+	AlgorithmDHash = "dHash"
+)
+
+// what happens when the new image and the latest one have different sizes, e.g. the page became shorter than the
+// clip or the viewport of the worker changed
+const (
+	// the images are aligned at the top left corner and padded to the same size, then compared as usual
+	SizePolicyPad = "pad"
+	// a different size is a change with 0 similarity
+	SizePolicyChange = "change"
+)
+
+// the thresholds used when an algorithm is chosen without one
+const (
+	DefaultSimilarityThreshold = 0.9999
+	DefaultSSIMThreshold       = 0.98
+	DefaultHashDistance        = 4
+)
+
+// HashBits is the size of the hash of [AlgorithmDHash]
+const HashBits = 64
+
+// MaxTriggerMasks is the maximum number of [Trigger.Masks]
+const MaxTriggerMasks = 20
+
+var ErrInvalidTrigger = errors.New("Invalid trigger.")
+
+// Stored as json string
+type Trigger struct {
+	// empty for sentries created before the algorithm was configurable, they use [AlgorithmMeanDifference]
+	Algorithm           string  `json:"algorithm,omitempty"`
+	SimilarityThreshold float64 `json:"similarityThreshold"`
+	SSIMThreshold       float64 `json:"ssimThreshold,omitempty"`
+	HashDistance        int     `json:"hashDistance,omitempty"`
+
+	// empty for [SizePolicyPad]
+	SizePolicy string `json:"sizePolicy,omitempty"`
+
+	// areas of the image that are ignored by every algorithm, e.g. a clock, relative to the top left corner of
+	// [TaskSpec.Clip]
+	Masks []Rect `json:"masks,omitempty"`
+
+	// conditions on the text of a text sentry, combined by [Trigger.Combine] (empty for [CombineAll]). If there are
+	// any, they decide when the sentry is notified instead of any changed line.
+	Conditions []Condition `json:"conditions,omitempty"`
+	Combine    string      `json:"combine,omitempty"`
+
+	// the thresholds of some [TaskSpec.Regions] by name, the others use the thresholds above
+	RegionThresholds map[string]RegionThreshold `json:"regionThresholds,omitempty"`
+}
+
+// RegionThreshold overrides the thresholds of [Trigger] for a region, nil ones aren't overridden
+type RegionThreshold struct {
+	SimilarityThreshold *float64 `json:"similarityThreshold,omitempty"`
+	SSIMThreshold       *float64 `json:"ssimThreshold,omitempty"`
+	HashDistance        *int     `json:"hashDistance,omitempty"`
+}
+
+// ParseTrigger parses and validates a stored trigger
+func ParseTrigger(s string) (*Trigger, error) {
+	var trigger Trigger
+	err := json.Unmarshal([]byte(s), &trigger)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &trigger, trigger.Validate()
+}
+
+// GetAlgorithm returns [Trigger.Algorithm], or [AlgorithmMeanDifference] if it is empty
+func (t *Trigger) GetAlgorithm() string {
+	if t.Algorithm == "" {
+		return AlgorithmMeanDifference
+	}
+	return t.Algorithm
+}
+
+// GetSizePolicy returns [Trigger.SizePolicy], or [SizePolicyPad] if it is empty
+func (t *Trigger) GetSizePolicy() string {
+	if t.SizePolicy == "" {
+		return SizePolicyPad
+	}
+	return t.SizePolicy
+}
+
+// SetAlgorithm switches the algorithm, its threshold is set to the default if there isn't one yet
+func (t *Trigger) SetAlgorithm(algorithm string) {
+	t.Algorithm = algorithm
+	switch algorithm {
+	case AlgorithmMeanDifference:
+		if t.SimilarityThreshold == 0 {
+			t.SimilarityThreshold = DefaultSimilarityThreshold
+		}
+	case AlgorithmSSIM:
+		if t.SSIMThreshold == 0 {
+			t.SSIMThreshold = DefaultSSIMThreshold
+		}
+	case AlgorithmDHash:
+		if t.HashDistance == 0 {
+			t.HashDistance = DefaultHashDistance
+		}
+	}
+}
+
+// Validate checks the algorithm and its threshold, thresholds of other algorithms are kept as they are
+func (t *Trigger) Validate() error {
+	switch t.GetAlgorithm() {
+	case AlgorithmMeanDifference:
+		if t.SimilarityThreshold <= 0 || t.SimilarityThreshold > 1 {
+			return errors.Wrap(ErrInvalidTrigger, "invalid similarityThreshold")
+		}
+	case AlgorithmSSIM:
+		if t.SSIMThreshold <= 0 || t.SSIMThreshold > 1 {
+			return errors.Wrap(ErrInvalidTrigger, "invalid ssimThreshold")
+		}
+	case AlgorithmDHash:
+		if t.HashDistance < 0 || t.HashDistance >= HashBits {
+			return errors.Wrap(ErrInvalidTrigger, "invalid hashDistance")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidTrigger, "unknown algorithm %q", t.Algorithm)
+	}
+	if p := t.GetSizePolicy(); p != SizePolicyPad && p != SizePolicyChange {
+		return errors.Wrapf(ErrInvalidTrigger, "unknown size policy %q", t.SizePolicy)
+	}
+	if len(t.Masks) > MaxTriggerMasks {
+		return errors.Wrap(ErrInvalidTrigger, "too many masks")
+	}
+	for _, m := range t.Masks {
+		if m.X < 0 || m.Y < 0 || m.Width <= 0 || m.Height <= 0 {
+			return errors.Wrap(ErrInvalidTrigger, "invalid mask")
+		}
+	}
+	if c := t.GetCombine(); c != CombineAll && c != CombineAny {
+		return errors.Wrapf(ErrInvalidTrigger, "unknown combine %q", t.Combine)
+	}
+	if len(t.Conditions) > MaxTriggerConditions {
+		return errors.Wrap(ErrInvalidTrigger, "too many conditions")
+	}
+	for i := range t.Conditions {
+		if err := t.Conditions[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if len(t.RegionThresholds) > MaxRegions {
+		return errors.Wrap(ErrInvalidTrigger, "too many region thresholds")
+	}
+	for name := range t.RegionThresholds {
+		r := t.withRegionThreshold(name)
+		// other thresholds of the region are checked if the algorithm is switched
+		r.RegionThresholds = nil
+		if err := r.Validate(); err != nil {
+			return errors.WithMessagef(err, "region %q", name)
+		}
+	}
+	return nil
+}
+
+// ValidateTask checks that the masks are inside the image taken by the task, which is [TaskSpec.Clip] or the
+// viewport (whose height is unknown) if there isn't a clip. Only text tasks can have conditions and they can't have
+// masks.
+func (t *Trigger) ValidateTask(task *TaskSpec) error {
+	if task.GetType() == TaskTypeText && len(t.Masks) > 0 {
+		return errors.Wrap(ErrInvalidTrigger, "masks on a text task")
+	}
+	if task.GetType() != TaskTypeText && len(t.Conditions) > 0 {
+		return errors.Wrap(ErrInvalidTrigger, "conditions on an image task")
+	}
+	width, height := task.Viewport.Width, -1
+	if task.Clip != nil {
+		width, height = task.Clip.Width, task.Clip.Height
+	}
+	for _, m := range t.Masks {
+		// not added up, they can be as large as an int
+		if m.Width > width-m.X || (height >= 0 && m.Height > height-m.Y) {
+			return errors.Wrap(ErrInvalidTrigger, "mask outside of the clip")
+		}
+	}
+	for name := range t.RegionThresholds {
+		found := false
+		for _, r := range task.Regions {
+			found = found || r.Name == name
+		}
+		if !found {
+			return errors.Wrapf(ErrInvalidTrigger, "unknown region %q", name)
+		}
+	}
+	return nil
+}
+
+func (t *Trigger) withRegionThreshold(name string) Trigger {
+	r := *t
+	if threshold, ok := t.RegionThresholds[name]; ok {
+		if threshold.SimilarityThreshold != nil {
+			r.SimilarityThreshold = *threshold.SimilarityThreshold
+		}
+		if threshold.SSIMThreshold != nil {
+			r.SSIMThreshold = *threshold.SSIMThreshold
+		}
+		if threshold.HashDistance != nil {
+			r.HashDistance = *threshold.HashDistance
+		}
+	}
+	return r
+}
+
+// ForRegion returns the trigger comparing the images of the region: the thresholds are the ones of the region and
+// the masks are relative to it.
+func (t *Trigger) ForRegion(task *TaskSpec, region Region) *Trigger {
+	r := t.withRegionThreshold(region.Name)
+	rect := task.RegionRectangle(region)
+	r.Masks = nil
+	for _, m := range t.Masks {
+		inter := m.Rectangle().Intersect(rect)
+		if inter.Empty() {
+			continue
+		}
+		inter = inter.Sub(rect.Min)
+		r.Masks = append(r.Masks, Rect{X: inter.Min.X, Y: inter.Min.Y, Width: inter.Dx(), Height: inter.Dy()})
+	}
+	r.RegionThresholds = nil
+	return &r
+}
+
+// MaskRectangles returns [Trigger.Masks] for the image comparison
+func (t *Trigger) MaskRectangles() []image.Rectangle {
+	masks := make([]image.Rectangle, len(t.Masks))
+	for i, m := range t.Masks {
+		masks[i] = m.Rectangle()
+	}
+	return masks
+}
+
+func (t *Trigger) JSON() (string, error) {
+	b, err := json.Marshal(t)
+	return string(b), errors.WithStack(err)
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RegisterWorker adds the worker or updates its version, capabilities and tags if it has been registered before.
+// The statistics are kept.
+func (t TX) RegisterWorker(w *Worker) error {
+	now := time.Now()
+	w.StartedAt = now
+	w.LastSeenAt = now
+	return t.tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"version", "capabilities", "tags", "protocol", "features", "ip",
+			"started_at", "last_seen_at"}),
+	}).Create(w).Error
+}
+
+// FeatureSet returns the features of the worker, see [FeatureMask]
+func (w *Worker) FeatureSet() int64 {
+	if w.Protocol < ProtocolV2 {
+		return LegacyFeatures
+	}
+	return w.Features
+}
+
+// WorkerHeartbeat records that the worker is alive. Workers that never called [RegisterWorker] are added
+// without version and capabilities.
+func (t TX) WorkerHeartbeat(id string, ip string) error {
+	now := time.Now()
+	return t.tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"ip", "last_seen_at"}),
+	}).Create(&Worker{ID: id, IP: ip, StartedAt: now, LastSeenAt: now}).Error
+}
+
+// AddWorkerStats adds to the task counters of the worker
+func (t TX) AddWorkerStats(id string, assigned int, completed int, failed int) error {
+	return t.tx.Model(&Worker{ID: id}).Updates(map[string]interface{}{
+		"assigned":  gorm.Expr("assigned + ?", assigned),
+		"completed": gorm.Expr("completed + ?", completed),
+		"failed":    gorm.Expr("failed + ?", failed),
+	}).Error
+}
+
+func (t TX) GetWorkers() (results []Worker, err error) {
+	err = t.tx.Order("last_seen_at DESC").Find(&results).Error
+	return
+}
+
+// Scopes of worker credentials, each allows the worker to run one [TaskMode]
+const (
+	ScopeFullScreenshot = "fullScreenshot"
+	ScopeSentry         = "sentry"
+)
+
+var scopeTaskModes = map[string]TaskMode{
+	ScopeFullScreenshot: TMFullScreenshot,
+	ScopeSentry:         TMSentry,
+}
+
+// ScopeTaskMode returns the task mode allowed by the scope, or false if the scope is unknown
+func ScopeTaskMode(scope string) (TaskMode, bool) {
+	m, ok := scopeTaskModes[scope]
+	return m, ok
+}
+
+// WorkerSigningKey returns the key signing the requests of a worker. [secret] is the hex of an ed25519 seed, it is
+// only known by the worker.
+func WorkerSigningKey(secret string) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(secret)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidWorkerSecret
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// WorkerPublicKey returns the key stored in [WorkerCredential.PublicKey]. It verifies the signatures of the worker
+// but can't sign requests.
+func WorkerPublicKey(secret string) (string, error) {
+	key, err := WorkerSigningKey(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// WorkerSignedMessage returns what is signed in a worker request
+func WorkerSignedMessage(method string, requestURI string, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:]))
+}
+
+// VerifyWorkerSignature checks the signature of [message] with [WorkerCredential.PublicKey]
+func (c *WorkerCredential) VerifyWorkerSignature(message []byte, signature []byte) bool {
+	key, err := hex.DecodeString(c.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, message, signature)
+}
+
+func (t TX) CreateWorkerCredential(c *WorkerCredential) error {
+	return t.tx.Create(c).Error
+}
+
+// GetWorkerCredential returns the credential with key ID [id], including revoked and expired ones
+func (t TX) GetWorkerCredential(id string) (*WorkerCredential, error) {
+	var result WorkerCredential
+	err := t.tx.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// HasActiveWorkerCredentials returns true if a credential that is neither revoked nor expired exists
+func (t TX) HasActiveWorkerCredentials() (bool, error) {
+	var count int64
+	err := t.tx.Model(&WorkerCredential{}).Where("revoked = ? AND (expire_at IS NULL OR expire_at > ?)", false,
+		time.Now()).Count(&count).Error
+	return count > 0, err
+}
+
+func (t TX) GetWorkerCredentials() (results []WorkerCredential, err error) {
+	err = t.tx.Order("created_at").Find(&results).Error
+	return
+}
+
+// RevokeWorkerCredential revokes the credential of the worker with [name], revoking it again is not an error
+func (t TX) RevokeWorkerCredential(name string) error {
+	// MySQL doesn't count the rows that are already revoked as affected
+	var result WorkerCredential
+	err := t.tx.Select("id").Where("name = ?", name).First(&result).Error
+	if err != nil {
+		return err
+	}
+	return t.tx.Model(&WorkerCredential{ID: result.ID}).Update("revoked", true).Error
+}
+
+// UseWorkerSignature records the signature, it returns false if it has been used (by any master)
+func (t TX) UseWorkerSignature(signature string) (bool, error) {
+	r := t.tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&WorkerSignature{Signature: signature, CreatedAt: time.Now()})
+	return r.RowsAffected == 1, r.Error
+}
+
+// DeleteWorkerSignatures deletes the signatures recorded before [before]
+func (t TX) DeleteWorkerSignatures(before time.Time) error {
+	return t.tx.Where("created_at < ?", before).Delete(&WorkerSignature{}).Error
+}
+
+// SharedKeyWorkerPrefix starts the ID of every worker using the shared key, so that they can't take the name of a
+// credential
+const SharedKeyWorkerPrefix = "key:"
+
+// a worker can have at most this many tags, because all combinations of them are used in queries
+const MaxWorkerTags = 8
+
+var ErrInvalidWorkerSecret = errors.New("Invalid worker secret.")
+
+// WorkerSignatureMaxAge is how long a signed request is valid, signed requests older than this (or this far in the
+// future) are rejected
+const WorkerSignatureMaxAge = 5 * time.Minute
+
+var (
+	ErrInvalidTag = errors.New("Invalid tag.")
+	tagPattern    = regexp.MustCompile(`^[a-z0-9_.-]+(=[a-z0-9_.-]+)?$`)
+)
+
+// ParseTags parses comma separated tags like "region=eu,mobile". The result is sorted without duplicates.
+func ParseTags(s string) ([]string, error) {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("%w %q", ErrInvalidTag, tag)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// NormalizeTags returns the form stored in [Sentry.RequiredTags] and [Task.RequiredTags]
+func NormalizeTags(tags []string) string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// tagSubsets returns the normalized form of every subset of [tags], including the empty one
+func tagSubsets(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	results := make([]string, 0, 1<<len(sorted))
+	for mask := 0; mask < 1<<len(sorted); mask++ {
+		var subset []string
+		for i, tag := range sorted {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, tag)
+			}
+		}
+		results = append(results, strings.Join(subset, ","))
+	}
+	return results
+}
+
+func (t TX) GetWorker(id string) (*Worker, error) {
+	var result Worker
+	err := t.tx.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
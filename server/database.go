@@ -3,6 +3,9 @@ package server
 import (
 	"fmt"
 
+	"github.com/glebarez/sqlite"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
@@ -13,6 +16,27 @@ func connectToDB(dbConfig config.Database) (*gorm.DB, error) {
 	switch dbConfig.Type {
 	case "postgres":
 		return gorm.Open(postgres.Open(dbConfig.DataSourceName), &gorm.Config{})
+	case "mysql":
+		dsnConfig, err := mysqldriver.ParseDSN(dbConfig.DataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		// [time.Time] can't be scanned from DATETIME columns without it
+		dsnConfig.ParseTime = true
+		return gorm.Open(mysql.New(mysql.Config{DSNConfig: dsnConfig}), &gorm.Config{})
+	case "sqlite":
+		db, err := gorm.Open(sqlite.Open(dbConfig.DataSourceName), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		// SQLite only allows one writer at a time, concurrent transactions would fail with
+		// "database is locked". An in-memory database also only lives in a single connection.
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+		return db, nil
 	default:
 		return nil, fmt.Errorf("Unsupported database type: %v", dbConfig.Type)
 	}
@@ -21,6 +21,11 @@ func setupRouter() *gin.Engine {
 	corsConfig.AllowOrigins = config.GetConfig().CROSAllowOrigins
 	corsConfig.AddAllowHeaders("WS-User-Token")
 	corsConfig.AddAllowHeaders("WS-Worker-Key")
+	corsConfig.AddAllowHeaders("WS-Worker-ID")
+	corsConfig.AddAllowHeaders("WS-Worker-Key-ID")
+	corsConfig.AddAllowHeaders("WS-Timestamp")
+	corsConfig.AddAllowHeaders("WS-Signature")
+	corsConfig.AddAllowHeaders("WS-Admin-Key")
 	r.Use(cors.New(corsConfig))
 
 	r.GET("/ping", func(c *gin.Context) {
@@ -66,6 +71,13 @@ func setupRouter() *gin.Engine {
 				{
 					screenshot.POST("/request_full_screenshot", controllers.SentryRequestFullScreenshot)
 				}
+
+				checkNow := sentryGroup.Group("")
+				checkNow.Use(middlewares.GetCheckNowLimiter())
+				{
+					checkNow.POST("/check_now", controllers.SentryCheckNow)
+				}
+				sentryGroup.POST("/wait_check", controllers.SentryWaitCheck)
 			}
 
 			// notification
@@ -85,12 +97,22 @@ func setupRouter() *gin.Engine {
 			workerGroup.POST("/init", controllers.WorkerInit)
 			workerGroup.POST("/fetch_task", controllers.WorkerFetchTask)
 			workerGroup.POST("/submit_task", controllers.WorkerSubmitTask)
+			workerGroup.POST("/task_heartbeat", controllers.WorkerTaskHeartbeat)
+			workerGroup.GET("/socket", controllers.WorkerSocket)
+		}
+
+		// admin
+		adminGroup := v1.Group("/admin")
+		adminGroup.Use(middlewares.AdminAuth)
+		{
+			adminGroup.POST("/worker/list", controllers.AdminWorkerList)
 		}
 
 		// common
 		commonGroup := v1.Group("/common")
 		{
 			commonGroup.GET("/get_history_image", controllers.GetHistoryImage)
+			commonGroup.GET("/get_history_text", controllers.GetHistoryText)
 			commonGroup.GET("/get_full_screenshot_image", controllers.GetFullScreenshotImage)
 		}
 
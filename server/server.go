@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/websentry/websentry/config"
@@ -10,6 +12,22 @@ import (
 	"github.com/websentry/websentry/utils"
 )
 
+// InitDB only loads the config and connects to the database without applying migrations.
+// It is used by commands that don't start the http server.
+func InitDB(configFile string) error {
+	err := config.Load(configFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := connectToDB(config.GetConfig().Database)
+	if err != nil {
+		return err
+	}
+
+	return models.InitWithoutMigration(db, config.GetConfig().NodeID)
+}
+
 func Init(configFile string) error {
 
 	err := config.Load(configFile)
@@ -22,10 +40,11 @@ func Init(configFile string) error {
 		return err
 	}
 
-	err = models.Init(db)
+	err = models.Init(db, config.GetConfig().NodeID)
 	if err != nil {
 		return err
 	}
+	models.SetMaxCheckJitter(time.Duration(config.GetConfig().Scheduler.MaxJitter) * time.Second)
 
 	controllers.Init()
 	middlewares.Init()
@@ -21,6 +21,7 @@ func Init() error {
 	// image
 	imageBasePath = path.Join(config.GetConfig().FileStoragePath, "sentry", "image", "orig")
 	imageThumbBasePath = path.Join(config.GetConfig().FileStoragePath, "sentry", "image", "thumb")
+	compareRowWorkers = config.GetConfig().Comparison.RowWorkers
 
 	err := os.MkdirAll(imageBasePath, os.ModePerm)
 	if err != nil {
@@ -31,6 +32,20 @@ func Init() error {
 		return errors.WithStack(err)
 	}
 
+	// text
+	textBasePath = path.Join(config.GetConfig().FileStoragePath, "sentry", "text")
+	err = os.MkdirAll(textBasePath, os.ModePerm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// task
+	taskBasePath = path.Join(config.GetConfig().FileStoragePath, "task")
+	err = os.MkdirAll(taskBasePath, os.ModePerm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	// token
 	secreteKey = []byte(config.GetConfig().TokenSecretKey)
 
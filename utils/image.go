@@ -2,9 +2,11 @@ package utils
 
 import (
 	"image"
+	"image/color"
+	"image/draw"
 	"image/png"
 	"log"
-	"math"
+	"math/bits"
 	"math/rand"
 	"os"
 	"path"
@@ -76,31 +78,142 @@ func ImageDelete(filename string, keepThumb bool) {
 	}
 }
 
-func pixelDifference(a uint32, b uint32) float64 {
-	return math.Abs(float64(a)-float64(b)) / 65535.0
+// maskedPixels marks the pixels of the image covered by [masks], which are relative to the top left corner.
+// It returns nil if nothing is masked.
+func maskedPixels(bounds image.Rectangle, masks []image.Rectangle) []bool {
+	if len(masks) == 0 {
+		return nil
+	}
+	width := bounds.Dx()
+	masked := make([]bool, width*bounds.Dy())
+	for _, m := range masks {
+		m = m.Add(bounds.Min).Intersect(bounds)
+		for y := m.Min.Y; y < m.Max.Y; y++ {
+			for x := m.Min.X; x < m.Max.X; x++ {
+				masked[(y-bounds.Min.Y)*width+x-bounds.Min.X] = true
+			}
+		}
+	}
+	return masked
+}
+
+// ImageFillMasks returns a copy of the image with [masks] painted black, so that they look the same in every image
+func ImageFillMasks(img image.Image, masks []image.Rectangle) image.Image {
+	if len(masks) == 0 {
+		return img
+	}
+	filled := imaging.Clone(img)
+	black := image.NewUniform(color.Black)
+	for _, m := range masks {
+		draw.Draw(filled, m, black, image.Point{}, draw.Src)
+	}
+	return filled
+}
+
+// ImageKeepRegions returns a copy of the image painted black outside of [regions]
+func ImageKeepRegions(img image.Image, regions []image.Rectangle) image.Image {
+	b := img.Bounds()
+	kept := image.NewNRGBA(image.Rectangle{Max: b.Size()})
+	draw.Draw(kept, kept.Rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	for _, r := range regions {
+		draw.Draw(kept, r, img, b.Min.Add(r.Min), draw.Src)
+	}
+	return kept
 }
 
-func ImageCompare(a image.Image, b image.Image) (float32, error) {
-	if a.Bounds() != b.Bounds() {
+// the side and the step of the windows of [ImageSSIM]
+const ssimWindow, ssimStep = 8, 4
+
+// luminance returns the gray levels (0-255) of the image, row by row
+func luminance(img image.Image) (gray []float64, width int, height int) {
+	g := imaging.Grayscale(img)
+	width, height = g.Rect.Dx(), g.Rect.Dy()
+	gray = make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		row := g.Pix[y*g.Stride:]
+		for x := 0; x < width; x++ {
+			gray[y*width+x] = float64(row[x*4])
+		}
+	}
+	return
+}
+
+// ImageSSIM returns the mean structural similarity of the luminance of the images over overlapping windows.
+// 1 means identical, it may be negative for very different images.
+func ImageSSIM(a image.Image, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
 		return 0, errors.New("images with different size")
 	}
+	ga, width, height := luminance(a)
+	gb, _, _ := luminance(b)
+	if width == 0 || height == 0 {
+		return 1, nil
+	}
 
-	bounds := a.Bounds()
-	total := 0
-	v := 0.0
-	for i := bounds.Min.X; i < bounds.Max.X; i++ {
-		for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+	ww, wh := ssimWindow, ssimWindow
+	if width < ww {
+		ww = width
+	}
+	if height < wh {
+		wh = height
+	}
+
+	// windowStarts makes sure the last window reaches the edge
+	windowStarts := func(size int, window int) []int {
+		var starts []int
+		for i := 0; i+window < size; i += ssimStep {
+			starts = append(starts, i)
+		}
+		return append(starts, size-window)
+	}
 
-			ar, ag, ab, _ := a.At(i, j).RGBA()
-			br, bg, bb, _ := b.At(i, j).RGBA()
-			v += pixelDifference(ar, br)
-			v += pixelDifference(ag, bg)
-			v += pixelDifference(ab, bb)
+	total := 0.0
+	windows := 0
+	n := float64(ww * wh)
+	for _, y0 := range windowStarts(height, wh) {
+		for _, x0 := range windowStarts(width, ww) {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := y0; y < y0+wh; y++ {
+				for x := x0; x < x0+ww; x++ {
+					pa, pb := ga[y*width+x], gb[y*width+x]
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+			varA, varB := sumAA/n-meanA*meanA, sumBB/n-meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	return total / float64(windows), nil
+}
 
-			total += 3
+// ImageDHash returns the difference hash of the image: it is shrunk to 9x8 gray pixels, and each bit tells whether
+// a pixel is brighter than its right neighbour. Similar images have hashes with a small Hamming distance.
+func ImageDHash(img image.Image) uint64 {
+	small := imaging.Resize(imaging.Grayscale(img), 9, 8, imaging.Box)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[y*small.Stride+x*4] > small.Pix[y*small.Stride+(x+1)*4] {
+				hash |= 1
+			}
 		}
 	}
-	return 1 - float32(v/float64(total)), nil
+	return hash
+}
+
+// ImageHashDistance returns the number of different bits of the [ImageDHash] of the images
+func ImageHashDistance(a image.Image, b image.Image) int {
+	return bits.OnesCount64(ImageDHash(a) ^ ImageDHash(b))
 }
 
 func ImageSave(image image.Image) (string, error) {
@@ -120,3 +233,33 @@ func ImageSave(image image.Image) (string, error) {
 
 	return filename, nil
 }
+
+// ImageSaveThumb only saves the thumb, for images that are never compared like [ImageDiff]
+func ImageSaveThumb(image image.Image) (string, error) {
+	filename := ImageRandomFilename()
+
+	// a higher quality keeps the highlighted pixels sharp
+	err := imaging.Save(image, ImageGetFullPath(filename, true), imaging.JPEGQuality(90))
+	err = errors.WithStack(err)
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+// ImagePad aligns the images at the top left corner and pads them with black to the size of the larger one
+func ImagePad(a image.Image, b image.Image) (image.Image, image.Image) {
+	sa, sb := a.Bounds().Size(), b.Bounds().Size()
+	if sa == sb {
+		return a, b
+	}
+	size := image.Rectangle{Max: sa}.Union(image.Rectangle{Max: sb})
+	pad := func(img image.Image) image.Image {
+		padded := image.NewNRGBA(size)
+		draw.Draw(padded, size, image.NewUniform(color.Black), image.Point{}, draw.Src)
+		draw.Draw(padded, size, img, img.Bounds().Min, draw.Src)
+		return padded
+	}
+	return pad(a), pad(b)
+}
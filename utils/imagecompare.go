@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"image"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// an image is only split between goroutines if each of them gets at least this many rows
+const minCompareRows = 64
+
+// goroutines comparing the rows of one image, see [config.Comparison]
+var compareRowWorkers = 1
+
+// rowReader writes the 16 bit premultiplied RGB channels of the pixels in row [y] to [buf], the same values as
+// [color.Color.RGBA]
+type rowReader func(y int, buf []uint32)
+
+// pixelReader reads the backing slices of *image.NRGBA and *image.RGBA directly, other images go through
+// [image.Image.At]
+func pixelReader(img image.Image) rowReader {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return func(y int, buf []uint32) {
+			pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:width*4]
+			for x := 0; x < width; x++ {
+				p := pix[x*4 : x*4+4]
+				r, g, b, a := uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101, uint32(p[3])
+				if a != 0xff {
+					// like [color.NRGBA.RGBA]
+					r, g, b = r*a/0xff, g*a/0xff, b*a/0xff
+				}
+				buf[x*3], buf[x*3+1], buf[x*3+2] = r, g, b
+			}
+		}
+	case *image.RGBA:
+		return func(y int, buf []uint32) {
+			pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:width*4]
+			for x := 0; x < width; x++ {
+				p := pix[x*4 : x*4+4]
+				buf[x*3], buf[x*3+1], buf[x*3+2] = uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101
+			}
+		}
+	default:
+		return func(y int, buf []uint32) {
+			for x := 0; x < width; x++ {
+				buf[x*3], buf[x*3+1], buf[x*3+2], _ = img.At(bounds.Min.X+x, y).RGBA()
+			}
+		}
+	}
+}
+
+// ImageCompare returns the similarity of the images. Pixels covered by [masks] (relative to the top left corner)
+// are excluded.
+// The result doesn't depend on the type of the images or on [compareRowWorkers], *image.NRGBA and *image.RGBA are
+// just faster.
+func ImageCompare(a image.Image, b image.Image, masks []image.Rectangle) (float32, error) {
+	if a.Bounds() != b.Bounds() {
+		return 0, errors.New("images with different size")
+	}
+
+	bounds := a.Bounds()
+	width := bounds.Dx()
+	masked := maskedPixels(bounds, masks)
+	readA, readB := pixelReader(a), pixelReader(b)
+
+	// the sums are integers, so the order of adding them up doesn't change the result
+	compareRows := func(from int, to int) (sum uint64, channels int) {
+		bufA, bufB := make([]uint32, width*3), make([]uint32, width*3)
+		for y := from; y < to; y++ {
+			readA(y, bufA)
+			readB(y, bufB)
+			row := (y - bounds.Min.Y) * width
+			for x := 0; x < width; x++ {
+				if masked != nil && masked[row+x] {
+					continue
+				}
+				for i := x * 3; i < x*3+3; i++ {
+					if bufA[i] > bufB[i] {
+						sum += uint64(bufA[i] - bufB[i])
+					} else {
+						sum += uint64(bufB[i] - bufA[i])
+					}
+				}
+				channels += 3
+			}
+		}
+		return
+	}
+
+	workers := compareRowWorkers
+	if limit := bounds.Dy() / minCompareRows; workers > limit {
+		workers = limit
+	}
+	var sum uint64
+	var total int
+	if workers <= 1 {
+		sum, total = compareRows(bounds.Min.Y, bounds.Max.Y)
+	} else {
+		var mux sync.Mutex
+		var wg sync.WaitGroup
+		rows := (bounds.Dy() + workers - 1) / workers
+		for from := bounds.Min.Y; from < bounds.Max.Y; from += rows {
+			to := from + rows
+			if to > bounds.Max.Y {
+				to = bounds.Max.Y
+			}
+			wg.Add(1)
+			go func(from int, to int) {
+				defer wg.Done()
+				s, c := compareRows(from, to)
+				mux.Lock()
+				sum += s
+				total += c
+				mux.Unlock()
+			}(from, to)
+		}
+		wg.Wait()
+	}
+
+	// everything is masked
+	if total == 0 {
+		return 1, nil
+	}
+	return 1 - float32(float64(sum)/65535/float64(total)), nil
+}
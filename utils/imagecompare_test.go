@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// legacyImageCompare is how images were compared before the fast paths, the results have to stay the same
+func legacyImageCompare(a image.Image, b image.Image) float32 {
+	bounds := a.Bounds()
+	total := 0
+	v := 0.0
+	for i := bounds.Min.X; i < bounds.Max.X; i++ {
+		for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+			ar, ag, ab, _ := a.At(i, j).RGBA()
+			br, bg, bb, _ := b.At(i, j).RGBA()
+			v += math.Abs(float64(ar)-float64(br)) / 65535.0
+			v += math.Abs(float64(ag)-float64(bg)) / 65535.0
+			v += math.Abs(float64(ab)-float64(bb)) / 65535.0
+			total += 3
+		}
+	}
+	return 1 - float32(v/float64(total))
+}
+
+// genericImage hides the type of the image, so that the generic path is used
+type genericImage struct {
+	image.Image
+}
+
+// testImages returns two similar random images, [alpha] makes some pixels transparent
+func testImages(r image.Rectangle, alpha bool) (*image.NRGBA, *image.NRGBA) {
+	rnd := rand.New(rand.NewSource(int64(r.Dx()*r.Dy()) + 1))
+	a, b := image.NewNRGBA(r), image.NewNRGBA(r)
+	for i := range a.Pix {
+		a.Pix[i] = uint8(rnd.Intn(256))
+		if i%4 == 3 && !alpha {
+			a.Pix[i] = 255
+		}
+		b.Pix[i] = a.Pix[i]
+		if rnd.Intn(10) == 0 && (alpha || i%4 != 3) {
+			b.Pix[i] = uint8(rnd.Intn(256))
+		}
+	}
+	return a, b
+}
+
+func toRGBA(img *image.NRGBA) *image.RGBA {
+	rgba := image.NewRGBA(img.Rect)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			rgba.Set(x, y, img.At(x, y))
+		}
+	}
+	return rgba
+}
+
+func TestImageCompare(t *testing.T) {
+	defer func(n int) { compareRowWorkers = n }(compareRowWorkers)
+
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 37, 23), image.Rect(5, 7, 405, 307)} {
+		for _, alpha := range []bool{false, true} {
+			a, b := testImages(r, alpha)
+			for _, workers := range []int{1, 4} {
+				compareRowWorkers = workers
+				for name, images := range map[string][2]image.Image{
+					"nrgba":   {a, b},
+					"rgba":    {toRGBA(a), toRGBA(b)},
+					"generic": {genericImage{a}, genericImage{b}},
+					"mixed":   {a, toRGBA(b)},
+				} {
+					// converting to RGBA loses precision of transparent pixels
+					expected := legacyImageCompare(images[0], images[1])
+					s, err := ImageCompare(images[0], images[1], nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if s != expected {
+						t.Errorf("%v %v alpha %v workers %d: %v, expected %v", r, name, alpha, workers, s, expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestImageCompareMasks(t *testing.T) {
+	a, b := testImages(image.Rect(0, 0, 40, 30), false)
+	masks := []image.Rectangle{image.Rect(10, 10, 20, 20)}
+	// only the masked pixels differ
+	same := image.NewNRGBA(a.Rect)
+	copy(same.Pix, a.Pix)
+	for y := 10; y < 20; y++ {
+		for x := 10; x < 20; x++ {
+			same.SetNRGBA(x, y, color.NRGBA{A: 255})
+		}
+	}
+	for _, images := range [][2]image.Image{{a, same}, {genericImage{a}, genericImage{same}}} {
+		s, err := ImageCompare(images[0], images[1], masks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != 1 {
+			t.Errorf("unexpected similarity: %v", s)
+		}
+	}
+
+	fast, _ := ImageCompare(a, b, masks)
+	generic, _ := ImageCompare(genericImage{a}, genericImage{b}, masks)
+	if fast != generic {
+		t.Errorf("fast path: %v, generic: %v", fast, generic)
+	}
+}
+
+// a clip of 500x500 is the largest one allowed by [SentryCreate], full page screenshots are larger
+var benchmarkRect = image.Rect(0, 0, 900, 2000)
+
+func benchmarkImageCompare(bm *testing.B, a image.Image, b image.Image, workers int) {
+	defer func(n int) { compareRowWorkers = n }(compareRowWorkers)
+	compareRowWorkers = workers
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		_, err := ImageCompare(a, b, nil)
+		if err != nil {
+			bm.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkImageCompareLegacy(bm *testing.B) {
+	a, b := testImages(benchmarkRect, false)
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		legacyImageCompare(a, b)
+	}
+}
+
+func BenchmarkImageCompareGeneric(bm *testing.B) {
+	a, b := testImages(benchmarkRect, false)
+	benchmarkImageCompare(bm, genericImage{a}, genericImage{b}, 1)
+}
+
+func BenchmarkImageCompareNRGBA(bm *testing.B) {
+	a, b := testImages(benchmarkRect, false)
+	benchmarkImageCompare(bm, a, b, 1)
+}
+
+func BenchmarkImageCompareRGBA(bm *testing.B) {
+	a, b := testImages(benchmarkRect, false)
+	benchmarkImageCompare(bm, toRGBA(a), toRGBA(b), 1)
+}
+
+func BenchmarkImageCompareMixed(bm *testing.B) {
+	a, b := testImages(benchmarkRect, false)
+	benchmarkImageCompare(bm, a, toRGBA(b), 1)
+}
+
+func BenchmarkImageCompareNRGBAParallel(bm *testing.B) {
+	a, b := testImages(benchmarkRect, false)
+	benchmarkImageCompare(bm, a, b, 4)
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// how much a channel (0-255) has to change to be highlighted, smaller differences are usually anti-aliasing
+	diffTolerance = 24
+	// changed pixels are grouped in cells of this size to find the changed regions
+	diffCell = 16
+	// the width of the boxes around changed regions
+	diffBorder = 2
+)
+
+var (
+	diffChangedColor = color.NRGBA{R: 255, A: 255}
+	diffBoxColor     = color.NRGBA{G: 90, B: 255, A: 255}
+)
+
+// ImageDiff renders the changes from [a] to [b]: [b] is faded to gray, changed pixels are red and changed regions
+// are boxed. It also returns the regions, relative to the top left corner. Pixels covered by [masks] are ignored.
+func ImageDiff(a image.Image, b image.Image, masks []image.Rectangle) (image.Image, []image.Rectangle, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return nil, nil, errors.New("images with different size")
+	}
+	na, nb := imaging.Clone(a), imaging.Clone(b)
+	bounds := nb.Rect
+	width, height := bounds.Dx(), bounds.Dy()
+	masked := maskedPixels(bounds, masks)
+
+	cellsX, cellsY := (width+diffCell-1)/diffCell, (height+diffCell-1)/diffCell
+	cells := make([]bool, cellsX*cellsY)
+
+	out := image.NewNRGBA(bounds)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*nb.Stride + x*4
+			pa, pb := na.Pix[i:i+3], nb.Pix[i:i+3]
+			changed := false
+			if masked == nil || !masked[y*width+x] {
+				for c := 0; c < 3; c++ {
+					d := int(pa[c]) - int(pb[c])
+					if d > diffTolerance || d < -diffTolerance {
+						changed = true
+						break
+					}
+				}
+			}
+			if changed {
+				out.SetNRGBA(x, y, diffChangedColor)
+				cells[(y/diffCell)*cellsX+x/diffCell] = true
+				continue
+			}
+			gray := (299*int(pb[0]) + 587*int(pb[1]) + 114*int(pb[2])) / 1000
+			faded := uint8(255 - (255-gray)/3)
+			out.SetNRGBA(x, y, color.NRGBA{R: faded, G: faded, B: faded, A: 255})
+		}
+	}
+
+	regions := changedRegions(cells, cellsX, cellsY, bounds)
+	for _, r := range regions {
+		drawBox(out, r)
+	}
+	return out, regions, nil
+}
+
+// changedRegions returns the bounding boxes of the groups of adjacent changed cells
+func changedRegions(cells []bool, cellsX int, cellsY int, bounds image.Rectangle) []image.Rectangle {
+	var regions []image.Rectangle
+	visited := make([]bool, len(cells))
+	for start := range cells {
+		if !cells[start] || visited[start] {
+			continue
+		}
+		visited[start] = true
+		region := image.Rectangle{}
+		stack := []int{start}
+		for len(stack) > 0 {
+			cell := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			cx, cy := cell%cellsX, cell/cellsX
+			r := image.Rect(cx*diffCell, cy*diffCell, (cx+1)*diffCell, (cy+1)*diffCell)
+			region = region.Union(r)
+
+			// the cells around it, including diagonal ones
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					x, y := cx+dx, cy+dy
+					if x < 0 || y < 0 || x >= cellsX || y >= cellsY {
+						continue
+					}
+					next := y*cellsX + x
+					if cells[next] && !visited[next] {
+						visited[next] = true
+						stack = append(stack, next)
+					}
+				}
+			}
+		}
+		regions = append(regions, region.Intersect(bounds))
+	}
+	return regions
+}
+
+// drawBox draws the border of [r] inside it
+func drawBox(img *image.NRGBA, r image.Rectangle) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if x-r.Min.X < diffBorder || r.Max.X-x <= diffBorder || y-r.Min.Y < diffBorder || r.Max.Y-y <= diffBorder {
+				img.SetNRGBA(x, y, diffBoxColor)
+			}
+		}
+	}
+}
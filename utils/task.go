@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// results submitted by workers are kept as files until the task is processed
+var taskBasePath string
+
+func taskResultPath(id int64) string {
+	return path.Join(taskBasePath, strconv.FormatInt(id, 10))
+}
+
+func TaskResultSave(id int64, data []byte) error {
+	return errors.WithStack(ioutil.WriteFile(taskResultPath(id), data, 0644))
+}
+
+func TaskResultRead(id int64) ([]byte, error) {
+	data, err := ioutil.ReadFile(taskResultPath(id))
+	return data, errors.WithStack(err)
+}
+
+// if failed, only log the error
+func TaskResultDelete(id int64) {
+	deleteFileAndIgnoreError(taskResultPath(id))
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// versions of text sentries
+var textBasePath string
+
+// need check filename if the filename comes from user, see [ImageCheckFilename]
+func TextGetFullPath(filename string) string {
+	return path.Join(textBasePath, filename+".txt")
+}
+
+func TextSave(text string) (string, error) {
+	var filename string
+	for {
+		filename = RandStringBytes(32)
+		_, err := os.Stat(TextGetFullPath(filename))
+		if os.IsNotExist(err) {
+			break
+		}
+	}
+
+	err := ioutil.WriteFile(TextGetFullPath(filename), []byte(text), 0644)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filename, nil
+}
+
+func TextRead(filename string) (string, error) {
+	data, err := ioutil.ReadFile(TextGetFullPath(filename))
+	return string(data), errors.WithStack(err)
+}
+
+// if failed, only log the error
+func TextDelete(filename string) {
+	deleteFileAndIgnoreError(TextGetFullPath(filename))
+}
+
+// TextLines splits the text into lines for [LineDiff]. Whitespace around the lines and empty lines are ignored,
+// they change with the layout more often than with the content.
+func TextLines(text string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// operations of [LineDiff]
+const (
+	LineEqual   = ' '
+	LineAdded   = '+'
+	LineRemoved = '-'
+)
+
+type DiffLine struct {
+	Op   byte // [LineEqual], [LineAdded] or [LineRemoved]
+	Text string
+}
+
+// LineDiff gives up looking for the shortest edit script after this many edits, the lines in between are
+// replaced as a whole
+const maxDiffEdits = 1000
+
+// LineDiff returns the shortest edit script from [a] to [b] with Myers' algorithm
+func LineDiff(a []string, b []string) []DiffLine {
+	// the common prefix and suffix are cheap to find and often most of the text
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var diff []DiffLine
+	for _, line := range a[:prefix] {
+		diff = append(diff, DiffLine{LineEqual, line})
+	}
+	middle := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if middle == nil {
+		for _, line := range a[prefix : len(a)-suffix] {
+			diff = append(diff, DiffLine{LineRemoved, line})
+		}
+		for _, line := range b[prefix : len(b)-suffix] {
+			diff = append(diff, DiffLine{LineAdded, line})
+		}
+	}
+	diff = append(diff, middle...)
+	for _, line := range a[len(a)-suffix:] {
+		diff = append(diff, DiffLine{LineEqual, line})
+	}
+	return diff
+}
+
+// myersDiff returns nil if it takes more than [maxDiffEdits] edits
+func myersDiff(a []string, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return []DiffLine{}
+	}
+	maxD := n + m
+	if maxD > maxDiffEdits {
+		maxD = maxDiffEdits
+	}
+	// v[k+offset] is the furthest x on diagonal k
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] is v[-d-1...d+1] before step d, to trace back the path
+	var trace [][]int
+	at := func(t []int, d int, k int) int {
+		return t[k+d+1]
+	}
+
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				// down: a line of b is added
+				x = v[k+1+offset]
+			} else {
+				// right: a line of a is removed
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	var reversed []DiffLine
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		t := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(t, d, k-1) < at(t, d, k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(t, d, prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, DiffLine{LineEqual, a[x]})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, DiffLine{LineAdded, b[y]})
+		} else {
+			x--
+			reversed = append(reversed, DiffLine{LineRemoved, a[x]})
+		}
+	}
+
+	diff := make([]DiffLine, len(reversed))
+	for i := range reversed {
+		diff[i] = reversed[len(reversed)-1-i]
+	}
+	return diff
+}
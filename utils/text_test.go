@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// lcs is the length of the longest common subsequence, the number of equal lines of a shortest edit script
+func lcs(a []string, b []string) int {
+	l := make([][]int, len(a)+1)
+	for i := range l {
+		l[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				l[i][j] = l[i+1][j+1] + 1
+			} else if l[i+1][j] > l[i][j+1] {
+				l[i][j] = l[i+1][j]
+			} else {
+				l[i][j] = l[i][j+1]
+			}
+		}
+	}
+	return l[0][0]
+}
+
+// checkDiff makes sure that the diff turns [a] into [b] and returns the number of equal lines
+func checkDiff(t *testing.T, a []string, b []string, diff []DiffLine) int {
+	old, new := []string{}, []string{}
+	equal := 0
+	for _, d := range diff {
+		switch d.Op {
+		case LineEqual:
+			old = append(old, d.Text)
+			new = append(new, d.Text)
+			equal++
+		case LineRemoved:
+			old = append(old, d.Text)
+		case LineAdded:
+			new = append(new, d.Text)
+		}
+	}
+	if !reflect.DeepEqual(old, append([]string{}, a...)) || !reflect.DeepEqual(new, append([]string{}, b...)) {
+		t.Fatalf("the diff of %q and %q is wrong: %q", a, b, diff)
+	}
+	return equal
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := LineDiff(TextLines("a\n  b \n\nc\nd\n"), TextLines("a\nc\nd\ne"))
+	expected := []DiffLine{{LineEqual, "a"}, {LineRemoved, "b"}, {LineEqual, "c"}, {LineEqual, "d"}, {LineAdded, "e"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: %q", diff)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rnd.Intn(30))
+		for i := range lines {
+			lines[i] = strconv.Itoa(rnd.Intn(6))
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		if equal := checkDiff(t, a, b, LineDiff(a, b)); equal != lcs(a, b) {
+			t.Fatalf("the diff of %q and %q is not the shortest: %d equal lines instead of %d", a, b, equal, lcs(a, b))
+		}
+	}
+
+	// too many edits to find the shortest one
+	a, b := make([]string, maxDiffEdits), make([]string, maxDiffEdits)
+	for i := range a {
+		a[i], b[i] = "a"+strconv.Itoa(i), "b"+strconv.Itoa(i)
+	}
+	a = append(a, "same")
+	b = append(b, "same")
+	if equal := checkDiff(t, a, b, LineDiff(a, b)); equal != 1 {
+		t.Errorf("unexpected equal lines: %d", equal)
+	}
+}
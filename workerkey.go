@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/websentry/websentry/models"
+	"github.com/websentry/websentry/server"
+)
+
+var workerKeyCommand = &cli.Command{
+	Name:  "worker-key",
+	Usage: "manage credentials of workers",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "issue",
+			Usage:     "issue a credential for a worker, the secret is only shown once",
+			ArgsUsage: "name",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "scope",
+					Value: cli.NewStringSlice(models.ScopeFullScreenshot, models.ScopeSentry),
+					Usage: "kinds of tasks the worker can run",
+				},
+				&cli.DurationFlag{
+					Name:  "expires",
+					Usage: "how long the credential is valid, it never expires by default",
+				},
+			},
+			Action: workerKeyIssue,
+		},
+		{
+			Name:   "list",
+			Usage:  "list all credentials",
+			Action: workerKeyList,
+		},
+		{
+			Name:      "revoke",
+			Usage:     "revoke the credential of a worker",
+			ArgsUsage: "name",
+			Action:    workerKeyRevoke,
+		},
+	},
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+func workerKeyIssue(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" || len(name) > 64 || strings.HasPrefix(name, models.SharedKeyWorkerPrefix) {
+		return fmt.Errorf("Invalid name: %q", name)
+	}
+	scopes := c.StringSlice("scope")
+	for _, s := range scopes {
+		if _, ok := models.ScopeTaskMode(s); !ok {
+			return fmt.Errorf("Unknown scope: %v", s)
+		}
+	}
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	// the seed of the signing key
+	secret, err := randomHex(ed25519.SeedSize)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := models.WorkerPublicKey(secret)
+	if err != nil {
+		return err
+	}
+
+	credential := &models.WorkerCredential{
+		ID:        id,
+		Name:      name,
+		PublicKey: publicKey,
+		Scopes:    string(scopesJSON),
+	}
+	if d := c.Duration("expires"); d > 0 {
+		expireAt := time.Now().Add(d)
+		credential.ExpireAt = &expireAt
+	}
+
+	err = server.InitDB(c.String("config"))
+	if err != nil {
+		return err
+	}
+	err = models.Transaction(func(tx models.TX) error {
+		return tx.CreateWorkerCredential(credential)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("key id: %s\nsecret: %s\n", id, secret)
+	return nil
+}
+
+func workerKeyList(c *cli.Context) error {
+	err := server.InitDB(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	var credentials []models.WorkerCredential
+	err = models.Transaction(func(tx models.TX) (err error) {
+		credentials, err = tx.GetWorkerCredentials()
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, w := range credentials {
+		var scopes []string
+		err = json.Unmarshal([]byte(w.Scopes), &scopes)
+		if err != nil {
+			return err
+		}
+		state := "active"
+		if w.Revoked {
+			state = "revoked"
+		} else if w.ExpireAt != nil && w.ExpireAt.Before(time.Now()) {
+			state = "expired"
+		}
+		expireAt := "never"
+		if w.ExpireAt != nil {
+			expireAt = w.ExpireAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-16s  %-20s  %-7s  expires: %-19s  scopes: %s\n", w.ID, w.Name, state, expireAt,
+			strings.Join(scopes, ","))
+	}
+	return nil
+}
+
+func workerKeyRevoke(c *cli.Context) error {
+	name := c.Args().First()
+	err := server.InitDB(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	err = models.Transaction(func(tx models.TX) error {
+		return tx.RevokeWorkerCredential(name)
+	})
+	if models.IsErrNoDocument(err) {
+		return fmt.Errorf("No credential for worker: %v", name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("revoked the credential of %s\n", name)
+	return nil
+}